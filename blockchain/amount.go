@@ -0,0 +1,43 @@
+package blockchain
+
+// An Amount is a number of coins. It is unsigned, so that no payment can be negative.
+// No legal amount (a payment, or a sum of payments) exceeds MAX_MONEY, the most coins that can ever exist.
+// Sums of amounts are always computed with AddAmounts, which refuses to go beyond MAX_MONEY (and so never overflows).
+// The subsidy schedule of every preset issues at most MAX_MONEY (see chain_params.go).
+
+type Amount uint64
+
+const MAX_MONEY Amount = 21000000
+
+// return a + b
+// return whether a + b is a legal amount
+func AddAmounts(a Amount, b Amount) (Amount, bool) {
+	if a > MAX_MONEY || b > MAX_MONEY-a {
+		return 0, false
+	}
+	return a + b, true
+}
+
+// return a + b, at most MAX_MONEY
+// For sums that only exceed MAX_MONEY on an inflated chain (e.g. a balance), so that they are never reset to 0
+func CapAmounts(a Amount, b Amount) Amount {
+	sum, ok := AddAmounts(a, b)
+	if !ok {
+		return MAX_MONEY
+	}
+	return sum
+}
+
+// return the sum of `amounts`
+// return whether every partial sum is a legal amount
+func SumAmounts(amounts ...Amount) (Amount, bool) {
+	sum := Amount(0)
+	for _, a := range amounts {
+		var ok bool
+		sum, ok = AddAmounts(sum, a)
+		if !ok {
+			return 0, false
+		}
+	}
+	return sum, true
+}
@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+
+	"Project2/utils"
+)
+
+// A utxo_view over a map: outpoint -> unspent payment
+type map_view map[string]UnspentOut
+
+func (v map_view) find(hash_tx []byte, idx int) (UnspentOut, bool) {
+	unspent, ok := v[Outpoint(hash_tx, idx)]
+	return unspent, ok
+}
+
+func TestAddAmounts(t *testing.T) {
+	cases := []struct {
+		a, b Amount
+		sum  Amount
+		ok   bool
+	}{
+		{0, 0, 0, true},
+		{1, 2, 3, true},
+		{MAX_MONEY, 0, MAX_MONEY, true},
+		{0, MAX_MONEY, MAX_MONEY, true},
+		{MAX_MONEY - 1, 1, MAX_MONEY, true},
+		{MAX_MONEY, 1, 0, false},
+		{1, MAX_MONEY, 0, false},
+		{MAX_MONEY + 1, 0, 0, false},
+		{0, MAX_MONEY + 1, 0, false},
+		{^Amount(0), 1, 0, false},
+		{1, ^Amount(0), 0, false},
+	}
+	for _, c := range cases {
+		sum, ok := AddAmounts(c.a, c.b)
+		if sum != c.sum || ok != c.ok {
+			t.Errorf("AddAmounts(%d, %d) = %d, %v, expect %d, %v", c.a, c.b, sum, ok, c.sum, c.ok)
+		}
+	}
+}
+
+func TestSumAmounts(t *testing.T) {
+	cases := []struct {
+		amounts []Amount
+		sum     Amount
+		ok      bool
+	}{
+		{nil, 0, true},
+		{[]Amount{MAX_MONEY}, MAX_MONEY, true},
+		{[]Amount{MAX_MONEY / 2, MAX_MONEY - MAX_MONEY/2}, MAX_MONEY, true},
+		{[]Amount{MAX_MONEY, 0, 0}, MAX_MONEY, true},
+		{[]Amount{MAX_MONEY, 1}, 0, false},
+		{[]Amount{MAX_MONEY / 2, MAX_MONEY / 2, MAX_MONEY / 2}, 0, false},
+		{[]Amount{MAX_MONEY + 1}, 0, false},
+		// Wraps to 0 in uint64, but a partial sum is illegal
+		{[]Amount{^Amount(0), 1}, 0, false},
+	}
+	for _, c := range cases {
+		sum, ok := SumAmounts(c.amounts...)
+		if sum != c.sum || ok != c.ok {
+			t.Errorf("SumAmounts(%v) = %d, %v, expect %d, %v", c.amounts, sum, ok, c.sum, c.ok)
+		}
+	}
+}
+
+func TestVerifyAmounts(t *testing.T) {
+	initiator := append([]byte{0x02}, make([]byte, 32)...)
+	initiator[32] = 1
+	addr := utils.PKToAdress(initiator)
+	cases := []struct {
+		name     string
+		incomes  []Amount
+		payments []Amount
+		fee      Amount
+		ok       bool
+	}{
+		{"pays all incomes", []Amount{10, 5}, []Amount{15}, 0, true},
+		{"leaves a fee", []Amount{10, 5}, []Amount{7, 3}, 5, true},
+		{"no payment", []Amount{10}, nil, 10, true},
+		{"incomes of MAX_MONEY", []Amount{MAX_MONEY - 1, 1}, []Amount{MAX_MONEY}, 0, true},
+		{"zero payment", []Amount{10}, []Amount{10, 0}, 0, false},
+		{"payments over MAX_MONEY", []Amount{MAX_MONEY}, []Amount{MAX_MONEY, 1}, 0, false},
+		{"payment over MAX_MONEY", []Amount{MAX_MONEY}, []Amount{MAX_MONEY + 1}, 0, false},
+		{"incomes over MAX_MONEY", []Amount{MAX_MONEY, 1}, []Amount{1}, 0, false},
+		{"payments over incomes", []Amount{10, 5}, []Amount{10, 6}, 0, false},
+	}
+	for _, c := range cases {
+		view := make(map_view)
+		tx := &Transaction{Initiator: initiator}
+		for i, amount := range c.incomes {
+			hash_tx := []byte(fmt.Sprintf("tx %d", i))
+			view[Outpoint(hash_tx, 0)] = UnspentOut{Out: Out{Amount: amount, Recipient: addr}, Height: 1}
+			tx.Incomes = append(tx.Incomes, In{HashTx: hash_tx, Idx: 0, Amount: amount})
+		}
+		for _, amount := range c.payments {
+			tx.Payments = append(tx.Payments, Out{Amount: amount, Recipient: addr})
+		}
+		in_amount, ok := tx.verify_incomes(view, 2, RegtestParams)
+		if ok {
+			_, ok = tx.verify_payments(in_amount)
+		}
+		if ok != c.ok {
+			t.Errorf("%s: verified %v, expect %v", c.name, ok, c.ok)
+			continue
+		}
+		if ok && tx.Fee() != c.fee {
+			t.Errorf("%s: fee %d, expect %d", c.name, tx.Fee(), c.fee)
+		}
+	}
+}
+
+func TestVerifyIncomes(t *testing.T) {
+	initiator := append([]byte{0x02}, make([]byte, 32)...)
+	initiator[32] = 1
+	other := append([]byte{0x02}, make([]byte, 32)...)
+	other[32] = 2
+	addr, other_addr := utils.PKToAdress(initiator), utils.PKToAdress(other)
+	view := map_view{
+		Outpoint([]byte("tx 0"), 0):   UnspentOut{Out: Out{Amount: 10, Recipient: addr}, Height: 1},
+		Outpoint([]byte("tx 0"), 1):   UnspentOut{Out: Out{Amount: 5, Recipient: addr}, Height: 1},
+		Outpoint([]byte("tx 1"), 0):   UnspentOut{Out: Out{Amount: 7, Recipient: other_addr}, Height: 1},
+		Outpoint([]byte("reward"), 0): UnspentOut{Out: Out{Amount: 50, Recipient: addr}, Height: 1, IsReward: true},
+	}
+	cases := []struct {
+		name      string
+		incomes   []In
+		is_reward bool
+		amount    Amount
+		ok        bool
+	}{
+		{"spends its payments", []In{{[]byte("tx 0"), 0, 10}, {[]byte("tx 0"), 1, 5}}, false, 15, true},
+		{"spends a mature reward", []In{{[]byte("reward"), 0, 50}}, false, 50, true},
+		{"not the initiator's payment", []In{{[]byte("tx 0"), 0, 10}, {[]byte("tx 1"), 0, 7}}, false, 0, false},
+		{"amount mismatch", []In{{[]byte("tx 0"), 0, 11}}, false, 0, false},
+		{"amount mismatch of a payment of the same tx", []In{{[]byte("tx 0"), 1, 10}}, false, 0, false},
+		{"duplicate input", []In{{[]byte("tx 0"), 0, 10}, {[]byte("tx 0"), 1, 5}, {[]byte("tx 0"), 0, 10}}, false, 0, false},
+		{"missing payment", []In{{[]byte("tx 0"), 2, 10}}, false, 0, false},
+		{"missing tx", []In{{[]byte("tx 2"), 0, 10}}, false, 0, false},
+		{"reward with incomes", []In{{[]byte("tx 0"), 0, 10}}, true, 0, false},
+	}
+	for _, c := range cases {
+		tx := &Transaction{Initiator: initiator, Incomes: c.incomes, IsReward: c.is_reward}
+		amount, ok := tx.verify_incomes(view, 2, RegtestParams)
+		if ok != c.ok || ok && amount != c.amount {
+			t.Errorf("%s: verify_incomes = %d, %v, expect %d, %v", c.name, amount, ok, c.amount, c.ok)
+		}
+	}
+}
+
+func TestSupplyAuditOverflow(t *testing.T) {
+	audit := &SupplyAudit{Issued: MAX_MONEY}
+	audit.add_unspent(MAX_MONEY)
+	if audit.Inflated() {
+		t.Errorf("audit of MAX_MONEY unspent is inflated")
+	}
+	audit.add_unspent(1)
+	if !audit.Inflated() || !audit.Overflow || audit.Unspent != MAX_MONEY {
+		t.Errorf("audit past MAX_MONEY is %+v, expect inflated with Unspent MAX_MONEY", audit)
+	}
+	if CapAmounts(MAX_MONEY, 1) != MAX_MONEY || CapAmounts(1, 2) != 3 {
+		t.Errorf("CapAmounts does not cap at MAX_MONEY")
+	}
+}
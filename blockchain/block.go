@@ -6,49 +6,56 @@ import (
 	"crypto/sha256"
 	"math/big"
 	"math/rand"
+	"sort"
 	"time"
-	"encoding/gob"
 	"strings"
 	"fmt"
 
-	"github.com/boltdb/bolt"
-
 	"Project2/utils"
 )
 
-const TBITS = 16 // threshold of pow = 1 << (256 - TBITS). Set 16 when demo.
-
 // A Block stores:
-// - A set of transactions (TODO: use Merkle Tree to store txs)
-// - A hash of all the txs (TODO: the root hash of the Merkle Tree)
+// - A set of transactions
+// - The root hash of the Merkle Tree of the txs (of their hashes, so that a tx can be proved by its id)
+// - The root hash of the Merkle Tree of the witness hashes of the txs (signatures included, see Transaction.WitnessHash)
 // - A hash of a block that is already in the blockchain
 // - A hash of itself
 // - Time of creation
 // - Nonce (for pow)
+// - Bits: the threshold of pow in compact form (see difficulty.go)
 // - Height: the distance from the genisis to this block
 // - Genisis: whether this block is genisis
 // A Block can:
 // - Serialize / Deserialize: to get stored on disk
 // - Print its information
+// - Give its work: the expected number of hashes to mine it
+// - Give the merkle proof of one of its txs, so that a light client can check the tx with only the block hash fields
+// - Select the txs a block on top of the tip can include
 // - *Blindly* mine a block from given txs: 
 // 		1. Find the hash of its previous block
 //		2. Run POW to find Nonce
 //		3. Compute the hash of the final block
 // - Verify legal block:
-//		0. Whether the block's TxHashes is correct
+//		0. Whether the block's MerkleRoot and WitnessRoot are correct
 //		1. Whether there is at most one reward
-//		2. Whether the block's prevhash is correct (no need for genisis)
+//		2. Whether the block's prevhash is correct (for genisis: whether it is the pinned genisis, and the chain has no other genisis)
 //		3. Whether the block's height is correct
-//		4. Whether the block's txs are legal
+//		3.5. Whether the block's bits follow the retarget rule, and its time is after its prevhash
+//		4. Whether the block's txs are legal, and no two of them spend the same payment
+//		   (in order: a tx can spend the payments of an earlier tx of the block)
+//		   and whether the reward is for the block's height
+//		   and whether the reward claims at most the subsidy at the block's height (see chain_params.go) + the fees of the other txs
 //		5. Whether the block's nonce is correct
 //		6. Whether the block's hash is correct
 
 type Block struct {
 	Txs	[]*Transaction
-	TxHashes	[]byte
+	MerkleRoot	[]byte
+	WitnessRoot	[]byte
 	PrevHash 	[]byte
 	Time 	int64 
 	Nonce 	int 
+	Bits	uint32
 	Height 	int 
 	IsGenisis	bool
 	Hash 	[]byte
@@ -57,7 +64,8 @@ type Block struct {
 func NewBlock(txs []*Transaction, genisis bool, bc *BlockChain) *Block {
 	new_block := Block {
 		Txs: []*Transaction{},
-		TxHashes: []byte{},
+		MerkleRoot: []byte{},
+		WitnessRoot: []byte{},
 		PrevHash: []byte{},
 		Time: time.Now().UnixNano(),
 		Nonce: 0,
@@ -67,21 +75,22 @@ func NewBlock(txs []*Transaction, genisis bool, bc *BlockChain) *Block {
 	// find prevhash and height
 	var prev_hash []byte
 	if !genisis {
-		err := bc.DB.View(func (tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte("blocks"))
-			// TODO: Caution: here is a concurrency issue: when getting the prevhash and the tip block, some new block may be added to the blockchain after getting prevhash but before getting tip block
-			// Don't know whether bolt db will ensure r/w exclusion in this case
-			db_prev_hash := bucket.Get([]byte("l"))
-			prev_hash = make([]byte, len(db_prev_hash))
-			copy(prev_hash, db_prev_hash)
-			tip_block := Deserialize(bucket.Get(prev_hash))
+		err := bc.Store.View(func (tx StoreTx) error {
+			prev_hash = tx.Tip()
+			tip_block := get_block(tx, prev_hash)
 			new_block.Height = tip_block.Height + 1
+			new_block.Bits = bc.Params.next_bits(tx, tip_block)
+			if new_block.Time <= tip_block.Time {
+				new_block.Time = tip_block.Time + 1
+			}
 			return nil
 		})
 		if err != nil {
 			log.Panic(err)
 		}
 		new_block.PrevHash = prev_hash
+	} else {
+		new_block.Bits = bc.Params.initial_bits()
 	}
 	// hash the txs
 	for _, tx := range txs {
@@ -93,7 +102,7 @@ func NewBlock(txs []*Transaction, genisis bool, bc *BlockChain) *Block {
 	for {
 		new_block.Nonce = rand.Int()
 		hash := new_block.mid_hash()
-		if is_acceptable_hash(hash) == true {
+		if new_block.is_acceptable_hash(hash) == true {
 			new_block.Hash = hash
 			elapsed := time.Since(start)
 			fmt.Printf("Mining time = %d ns\n", elapsed.Nanoseconds())
@@ -102,41 +111,115 @@ func NewBlock(txs []*Transaction, genisis bool, bc *BlockChain) *Block {
 	}
 }
 
+// Select the txs of `txs` that a block on top of the tip can include, ordered so that a tx comes after the txs whose payments it spends
+// A tx is left out if it is not legal, spends a payment already spent by a selected tx, or spends a payment that no selected tx pays
+func (bc *BlockChain) SelectTxs(txs []*Transaction) []*Transaction {
+	height := bc.Height() + 1
+	view := new_overlay_view(bc.utxo_view([]byte{}))
+	rest := make([]*Transaction, 0, len(txs))
+	for _, tx := range txs {
+		if !tx.IsReward {
+			rest = append(rest, tx)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return bytes.Compare(rest[i].Hash, rest[j].Hash) < 0
+	})
+	selected := []*Transaction{}
+	// Select the txs whose incomes are all unspent, until no more tx can be selected
+	for found := true; found; {
+		found = false
+		var next []*Transaction
+		for _, tx := range rest {
+			if !tx.spendable(view) {
+				next = append(next, tx)
+				continue
+			}
+			if _, ok := tx.verify(view, height, bc.Params); ok {
+				apply_tx(view, tx, height)
+				selected = append(selected, tx)
+				found = true
+			}
+		}
+		rest = next
+	}
+	return selected
+}
+
 func (b *Block) Verify(bc *BlockChain) bool {
 	start := time.Now()
-	res := b.verify_reward() && b.verify_txhashes() && b.verify_prevhash_and_height(bc) && b.verify_txs(bc) && b.verify_nonce_and_hash()
+	res := b.verify_reward() && b.verify_merkle_root() && b.verify_prevhash_and_height(bc) && b.verify_bits_and_time(bc) && b.verify_txs(bc) && b.verify_nonce_and_hash()
 	elapsed := time.Since(start)
 	fmt.Printf("Verifying block time = %d ns\n", elapsed.Nanoseconds())
 	return res
 }
 
+// Verify what can be verified of a block whose prevhash is unknown (e.g. before keeping it as an orphan):
+// its merkle root, its bits (not easier than the easiest threshold of the chain) and its nonce and hash
+func (b *Block) VerifyOrphan(params *ChainParams) bool {
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(256-params.MinTBits))
+	if utils.CompactToBig(b.Bits).Cmp(limit) > 0 {
+		fmt.Printf("VerifyOrphan: bits %08x easier than the chain allows\n", b.Bits)
+		return false
+	}
+	return b.verify_merkle_root() && b.verify_nonce_and_hash()
+}
+
 func (b *Block) HashTxs() {
+	b.MerkleRoot = b.merkle_tree().Root()
+	b.WitnessRoot = b.witness_tree().Root()
+}
+
+// Return the proof that tx `hash_tx` is in block `b`, checked by VerifyMerkleProof(b.MerkleRoot, hash_tx, proof)
+// Return false if the tx is not in the block
+func (b *Block) MerkleProof(hash_tx []byte) ([]MerkleProofNode, bool) {
+	for idx, tx := range b.Txs {
+		if bytes.Compare(tx.Hash, hash_tx) == 0 {
+			return b.merkle_tree().Proof(idx), true
+		}
+	}
+	return nil, false
+}
+
+func (b *Block) merkle_tree() *MerkleTree {
 	var tx_hashes [][]byte
 	for _, tx := range b.Txs {
 		tx_hashes = append(tx_hashes, tx.Hash)
 	}
-	hash := sha256.Sum256(bytes.Join(tx_hashes, []byte{}))
-	b.TxHashes = hash[:]
+	return NewMerkleTree(tx_hashes)
 }
 
-func (b *Block) Serialize() []byte {
-	var data bytes.Buffer
-	encoder := gob.NewEncoder(&data)
-	err := encoder.Encode(*b)
-	if err != nil {
-		log.Panic(err)
+// Return the proof that the tx of witness hash `witness_hash` is in block `b` with its signature,
+// checked by VerifyMerkleProof(b.WitnessRoot, witness_hash, proof)
+// Return false if the tx is not in the block
+func (b *Block) WitnessProof(witness_hash []byte) ([]MerkleProofNode, bool) {
+	for idx, tx := range b.Txs {
+		if bytes.Compare(tx.WitnessHash(), witness_hash) == 0 {
+			return b.witness_tree().Proof(idx), true
+		}
 	}
-	return data.Bytes()
+	return nil, false
+}
+
+func (b *Block) witness_tree() *MerkleTree {
+	var witness_hashes [][]byte
+	for _, tx := range b.Txs {
+		witness_hashes = append(witness_hashes, tx.WitnessHash())
+	}
+	return NewMerkleTree(witness_hashes)
+}
+
+// The canonical encoding of the block (see encoding.go), to get stored on disk
+func (b *Block) Serialize() []byte {
+	return b.Encode()
 }
 
 func Deserialize(data []byte) *Block {
-	var block Block 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&block)
+	b, err := DecodeBlock(data)
 	if err != nil {
 		log.Panic(err)
 	}
-	return &block
+	return b
 }
 
 func (b *Block) PrintBlock() string {
@@ -145,30 +228,21 @@ func (b *Block) PrintBlock() string {
 	string_block = append(string_block, fmt.Sprintf("\tPrevHash: %x", b.PrevHash))
 	string_block = append(string_block, fmt.Sprintf("\tTime: %d", b.Time))
 	string_block = append(string_block, fmt.Sprintf("\tNonce: %d", b.Nonce))
+	string_block = append(string_block, fmt.Sprintf("\tBits: %08x", b.Bits))
 	string_block = append(string_block, fmt.Sprintf("\tHeight: %d", b.Height))
 	if b.IsGenisis {
 		string_block = append(string_block, fmt.Sprintf("\tIsGenisis: True"))
 	} else {
 		string_block = append(string_block, fmt.Sprintf("\tIsGenisis: False"))
 	}
-	string_block = append(string_block, fmt.Sprintf("\tTxHashes: %x", b.TxHashes))
+	string_block = append(string_block, fmt.Sprintf("\tMerkleRoot: %x", b.MerkleRoot))
+	string_block = append(string_block, fmt.Sprintf("\tWitnessRoot: %x", b.WitnessRoot))
 	for _, tx := range b.Txs {
 		string_block = append(string_block, tx.PrintTx())
 	}
 	return strings.Join(string_block, "\n")
 }
 
-// Find whether `hash_tx` tx is in block `b`
-// TODO: Can be improved from O(n) to O(log n) using Merkle Tree
-func (b *Block) find_tx(hash_tx []byte) *Transaction {
-	for _, tx := range b.Txs {
-		if bytes.Compare(tx.Hash, hash_tx) == 0 {
-			return tx
-		}
-	}
-	return nil
-}
-
 func (b *Block) verify_reward() bool {
 	num_reward := 0
 	for _, tx := range b.Txs {
@@ -184,11 +258,13 @@ func (b *Block) verify_reward() bool {
 }
 
 
-func (b *Block) verify_txhashes() bool {
-	tmp_b := *b
-	tmp_b.HashTxs()
-	if bytes.Compare(tmp_b.TxHashes, b.TxHashes) != 0 {
-		fmt.Printf("verify_txhashes: wrong TxHashes\n")
+func (b *Block) verify_merkle_root() bool {
+	if bytes.Compare(b.merkle_tree().Root(), b.MerkleRoot) != 0 {
+		fmt.Printf("verify_merkle_root: wrong MerkleRoot\n")
+		return false
+	}
+	if bytes.Compare(b.witness_tree().Root(), b.WitnessRoot) != 0 {
+		fmt.Printf("verify_merkle_root: wrong WitnessRoot\n")
 		return false
 	}
 	return true
@@ -196,30 +272,31 @@ func (b *Block) verify_txhashes() bool {
 
 func (b *Block) verify_prevhash_and_height(bc *BlockChain) bool {
 	if b.IsGenisis {
-		if b.Height == 0 {
-			return true
-		} else {
-			fmt.Printf("verify_prevhash_and_height: genisis height not 0\n")
+		if b.Height != 0 || len(b.PrevHash) != 0 {
+			fmt.Printf("verify_prevhash_and_height: genisis height not 0 or has prevhash\n")
 			return false
 		}
-	}
-	iter := NewBlockChainIterator(bc)
-	for {
-		cur_block := iter.Next()
-		if bytes.Compare(cur_block.Hash, b.PrevHash) == 0 {
-			if cur_block.Height + 1 == b.Height {
-				return true
-			} else {
-				fmt.Printf("verify_prevhash_and_height: wrong height\n")
-				return false
-			}
+		if len(bc.Params.GenesisHash) != 0 && bytes.Compare(b.Hash, bc.Params.GenesisHash) != 0 {
+			fmt.Printf("verify_prevhash_and_height: genisis %x is not the pinned genisis %x\n", b.Hash, bc.Params.GenesisHash)
+			return false
 		}
-		if cur_block.IsGenisis {
-			break
+		if genesis := bc.Genesis(); genesis != nil && bytes.Compare(b.Hash, genesis) != 0 {
+			fmt.Printf("verify_prevhash_and_height: the chain already has genisis %x\n", genesis)
+			return false
 		}
+		return true
 	}
-	fmt.Printf("verify_prevhash_and_height: prevhash doesn't exist\n")
-	return false
+	// The previous block may be on any branch, not only on the main chain
+	prev_block := bc.GetBlock(b.PrevHash)
+	if prev_block == nil {
+		fmt.Printf("verify_prevhash_and_height: prevhash doesn't exist\n")
+		return false
+	}
+	if prev_block.Height + 1 != b.Height {
+		fmt.Printf("verify_prevhash_and_height: wrong height\n")
+		return false
+	}
+	return true
 }
 
 
@@ -230,18 +307,58 @@ func (b *Block) verify_txs(bc *BlockChain) bool {
 			return false
 		}
 	}
+	// The txs are verified in order, each on top of the ones before it: a tx can spend the payments
+	// of an earlier tx of the block, but not a payment that an earlier tx has spent
+	view := new_overlay_view(bc.utxo_view(b.PrevHash))
+	spent := make(map[string]bool) // payments spent by the txs of the block so far
+	fees := Amount(0)
+	claimed := Amount(0) // by the reward tx
 	for _, tx := range b.Txs {
-		if tx.Verify(bc, b.PrevHash) == false {
+		for _, in := range tx.Incomes {
+			if spent[Outpoint(in.HashTx, in.Idx)] {
+				fmt.Printf("verify_txs: tx %x double-spends the %d-th payment of tx %x in the block\n", tx.Hash, in.Idx, in.HashTx)
+				return false
+			}
+		}
+		fee, ok := tx.verify(view, b.Height, bc.Params)
+		if !ok {
 			fmt.Print("verify_txs: wrong tx\n")
 			return false
 		}
+		if tx.IsReward {
+			if tx.Height != b.Height {
+				fmt.Printf("verify_txs: reward is for height %d, not %d\n", tx.Height, b.Height)
+				return false
+			}
+			claimed = fee
+			continue
+		}
+		if tx.Height != 0 {
+			fmt.Printf("verify_txs: non-reward tx %x has a height\n", tx.Hash)
+			return false
+		}
+		fees, ok = AddAmounts(fees, fee)
+		if !ok {
+			fmt.Printf("verify_txs: sum of fees exceeds MAX_MONEY\n")
+			return false
+		}
+		for _, in := range tx.Incomes {
+			spent[Outpoint(in.HashTx, in.Idx)] = true
+		}
+		apply_tx(view, tx, b.Height)
+	}
+	// The reward tx can claim the subsidy and the fees of the block, but no more
+	max_claim, _ := AddAmounts(bc.Params.Subsidy(b.Height), fees)
+	if claimed > max_claim {
+		fmt.Printf("verify_txs: reward claims %d, more than subsidy + fees = %d\n", claimed, max_claim)
+		return false
 	}
 	return true
 }
 
 func (b *Block) verify_nonce_and_hash() bool {
 	hash := b.mid_hash()
-	if is_acceptable_hash(hash) == false {
+	if b.is_acceptable_hash(hash) == false {
 		fmt.Printf("verify_nonce_and_hash: wrong nonce\n")
 		return false
 	}
@@ -252,30 +369,29 @@ func (b *Block) verify_nonce_and_hash() bool {
 	return true
 }
 
+// The hash of the header of the block (see encoding.go)
 func (b *Block) mid_hash() []byte {
-	data := bytes.Join(
-		[][]byte{
-			b.TxHashes,
-			b.PrevHash,
-			utils.IntToHex(b.Time),
-			utils.IntToHex(int64(b.Nonce)),
-			utils.IntToHex(int64(b.Height)),
-			utils.BoolToHex(b.IsGenisis),
-			utils.IntToHex(TBITS),
-		},
-		[]byte{},
-	)
-	hash := sha256.Sum256(data)
+	hash := sha256.Sum256(b.EncodeHeader())
 	return hash[:]
 }
-func is_acceptable_hash(hash []byte) bool {
+
+func (b *Block) is_acceptable_hash(hash []byte) bool {
 	var hashInt big.Int
 	hashInt.SetBytes(hash)
-	threshold := big.NewInt(1)
-	threshold.Lsh(threshold, uint(256 - TBITS))
-	if hashInt.Cmp(threshold) == -1 {
+	if hashInt.Cmp(utils.CompactToBig(b.Bits)) == -1 {
 		return true
 	}
 	return false
 }
 
+// The expected number of hashes to mine the block: 2^256 / (threshold + 1), at least 1 so that every block adds work
+func (b *Block) Work() *big.Int {
+	threshold := utils.CompactToBig(b.Bits)
+	work := big.NewInt(1)
+	work.Lsh(work, 256)
+	work.Div(work, threshold.Add(threshold, big.NewInt(1)))
+	if work.Sign() == 0 {
+		work.SetInt64(1)
+	}
+	return work
+}
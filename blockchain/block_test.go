@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"testing"
+)
+
+func TestVerifyTxsInBlock(t *testing.T) {
+	a, b, miner := new_test_key(t), new_test_key(t), new_test_key(t)
+	bc := new_test_chain(t)
+	genesis := mine(t, bc, a)
+	reward := []In{{HashTx: genesis.Txs[0].Hash, Idx: 0, Amount: 50}}
+	pay_b, err := NewPayment(a, reward, b.address(), 10, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay_miner, err := NewPayment(a, reward, miner.address(), 20, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b spends the payment of `pay_b` in the same block
+	child, err := NewPayment(b, []In{{HashTx: pay_b.Hash, Idx: 0, Amount: 10}}, a.address(), 5, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		txs  []*Transaction
+		ok   bool
+	}{
+		{"one payment", []*Transaction{pay_b}, true},
+		{"two txs spend the same payment", []*Transaction{pay_b, pay_miner}, false},
+		{"parent then child", []*Transaction{pay_b, child}, true},
+		{"child before its parent", []*Transaction{child, pay_b}, false},
+	}
+	for _, c := range cases {
+		fees := Amount(0)
+		for _, tx := range c.txs {
+			fees += tx.Fee()
+		}
+		txs := append(append([]*Transaction{}, c.txs...), NewTransaction(miner, "", 0, fees, true, bc))
+		if ok := NewBlock(txs, false, bc).verify_txs(bc); ok != c.ok {
+			t.Errorf("%s: verify_txs = %v, expect %v", c.name, ok, c.ok)
+		}
+	}
+	// The chain of the block is connected in order
+	block := mine(t, bc, miner, pay_b, child)
+	u := UTXOSet{bc}
+	if _, ok := u.Find(pay_b.Hash, 0); ok {
+		t.Errorf("the payment of %x spent by %x in block %d is unspent", pay_b.Hash, child.Hash, block.Height)
+	}
+	if balance := u.Balance(b.address().Bytes()); balance != 4 {
+		t.Errorf("balance of b is %d, expect 4", balance)
+	}
+}
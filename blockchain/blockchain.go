@@ -5,95 +5,255 @@ import (
 	"strings"
 	"bytes"
 	"fmt"
+	"errors"
+	"math/big"
 
-	"github.com/boltdb/bolt"
+	"Project2/utils"
 )
 
 // A BlockChain stores:
-// - DB: the offline place where the blockchain is stored
+// - Store: the place where the blockchain is stored (a bolt db on disk, or memory, see chain_store.go)
+//		blocks, and the hash of the tip
+//		"utxo", "undo" indexes: see utxo_set.go
+//		"meta" index: "version" -> schema version of the store, "chain" -> name of the params, "genesis" -> hash of the genisis
+//		"work" index: hash of a block -> total work of the branch ending at the block
 // A BlockChain can:
+// - Be opened again after a restart, resuming from its tip
 // - Append a block to the chain:
-//		1. Verify legal block
+//		1. Verify legal block (a genisis must be the genisis pinned in the params, or the first one if none is pinned)
 //		2. If legal, update the blockchain
 //		3. If not legal, yell and do nothing
+// - Choose the tip: the block with the most total work. On a tie, the block seen first.
+//   (Never the self-reported Time of a block, which its miner can backdate.)
+// - Keep the "utxo" index consistent with the tip (in the same store tx that moves the tip):
+//		1. If the new tip extends the old tip, connect the new block to the utxo set
+//		2. If the new tip is on another branch, reorg (see reorg.go) and notify the OnReorg handlers
 
 const DBDIR = "/osdata/osgroup10/blockchain-"
+const SCHEMA_VERSION = 9 // bump when the layout of the store (or of a block) changes
+const META_INDEX = "meta"
+const WORK_INDEX = "work"
 
 type BlockChain struct {
-	DB	*bolt.DB
+	Store	ChainStore
+	Params	*ChainParams
+	reorg_handlers	[]func(*ReorgEvent)
 }
 
+// Options of OpenBlockChain
+// - GenesisHash: if not empty, pin this genisis (instead of the genisis pinned in Params): an existing chain must start from it, and no other genisis is accepted
+// - Params: the consensus rules of the chain (DefaultParams if nil)
+type Options struct {
+	GenesisHash	[]byte
+	Params	*ChainParams
+}
+
+// Open the blockchain of `machine_id` under DBDIR, panic on failure
 func NewBlockChain(machine_id string) *BlockChain {
-	filename := DBDIR + machine_id + ".db"
-	db, err := bolt.Open(filename, 0644, nil)
+	bc, err := OpenBlockChain(DBDIR + machine_id + ".db", nil)
 	if err != nil {
 		log.Panic(err)
 	}
-	err = db.Update(func (tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte("blocks"))
-		if err != nil {
-			log.Panic(err)
+	return bc
+}
+
+// Open the blockchain stored in the bolt db at `path`, or create an empty one if there is none.
+func OpenBlockChain(path string, opts *Options) (*BlockChain, error) {
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open %s: %v", path, err)
+	}
+	bc, err := OpenBlockChainStore(store, opts)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("fail to open %s: %v", path, err)
+	}
+	return bc, nil
+}
+
+// Open the blockchain in `store`.
+// Return an error if the params are not valid (see ChainParams.Validate)
+// An existing chain is resumed from its tip, after checking:
+//		1. The schema version of the store is SCHEMA_VERSION
+//		2. The store is a chain named `opts.Params.Name`
+//		3. The genisis of the store is the pinned genisis (if any)
+func OpenBlockChainStore(store ChainStore, opts *Options) (*BlockChain, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	params := opts.Params
+	if params == nil {
+		params = DefaultParams
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if len(opts.GenesisHash) != 0 {
+		if len(params.GenesisHash) != 0 && bytes.Compare(params.GenesisHash, opts.GenesisHash) != 0 {
+			return nil, fmt.Errorf("genisis %x is pinned by chain %s, expect %x", params.GenesisHash, params.Name, opts.GenesisHash)
+		}
+		pinned := *params
+		pinned.GenesisHash = opts.GenesisHash
+		params = &pinned
+	}
+	err := store.Update(func (tx StoreTx) error {
+		version := tx.Get(META_INDEX, []byte("version"))
+		if version == nil {
+			tx.Put(META_INDEX, []byte("version"), utils.IntToHex(SCHEMA_VERSION))
+		} else if bytes.Compare(version, utils.IntToHex(SCHEMA_VERSION)) != 0 {
+			return fmt.Errorf("schema version is %x, expect %d", version, SCHEMA_VERSION)
+		}
+		chain := tx.Get(META_INDEX, []byte("chain"))
+		if chain == nil {
+			tx.Put(META_INDEX, []byte("chain"), []byte(params.Name))
+		} else if string(chain) != params.Name {
+			return fmt.Errorf("chain is %s, expect %s", chain, params.Name)
+		}
+		genesis := tx.Get(META_INDEX, []byte("genesis"))
+		if len(params.GenesisHash) != 0 && genesis != nil && bytes.Compare(genesis, params.GenesisHash) != 0 {
+			return fmt.Errorf("genisis is %x, expect %x", genesis, params.GenesisHash)
+		}
+		tip := tx.Tip()
+		if tip == nil {
+			return nil
+		}
+		if index_empty(tx, UTXO_INDEX) {
+			// Also rebuilds the undo data of the main chain
+			reindex_utxo(tx)
 		}
+		fmt.Printf("Resume blockchain from tip %x\n", tip)
 		return nil
 	})
-	//fmt.Printf("New block chain created\n")///////////////////////////////////////////////////
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	return &BlockChain {
-		DB: db,
+		Store: store,
+		Params: params,
+	}, nil
+}
+
+func (bc *BlockChain) Close() error {
+	return bc.Store.Close()
+}
+
+// Return the hash of the tip, nil if the chain is empty
+func (bc *BlockChain) Tip() []byte {
+	var tip []byte
+	err := bc.Store.View(func (tx StoreTx) error {
+		tip = tx.Tip()
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return tip
+}
+
+// Return the height of the tip, -1 if the chain is empty
+func (bc *BlockChain) Height() int {
+	height := -1
+	err := bc.Store.View(func (tx StoreTx) error {
+		if tip := tx.Tip(); tip != nil {
+			height = get_block(tx, tip).Height
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
 	}
+	return height
 }
 
-func (bc *BlockChain) AppendBlock(b *Block) {
+// Return whether `b` is legal (and stored)
+func (bc *BlockChain) AppendBlock(b *Block) bool {
 	//fmt.Printf("Append block %#v\n", *b)//////////////////////////////////////////////////////
 	if b.Verify(bc) == false {
 		fmt.Printf("Invalid block\n")/////////////////////////////////////////////////
-		return
+		return false
 	}
-	data := b.Serialize()
 
-	err := bc.DB.Update(func (tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("blocks"))
-		err := bucket.Put(b.Hash, data)
-		if err != nil {
-			log.Panic(err)
-		}
-		if b.IsGenisis{
-			err = bucket.Put([]byte("l"), b.Hash)
-			if err != nil {
-				log.Panic(err)
+	var event *ReorgEvent
+	rejected := false
+	err := bc.Store.Update(func (tx StoreTx) error {
+		if b.IsGenisis {
+			// Another genisis may have been appended since `b` was verified
+			if genesis := tx.Get(META_INDEX, []byte("genesis")); genesis != nil {
+				rejected = bytes.Compare(genesis, b.Hash) != 0
+				return nil
 			}
+			tx.PutBlock(b)
+			tx.SetTip(b.Hash)
+			tx.Put(META_INDEX, []byte("genesis"), b.Hash)
+			tx.Put(WORK_INDEX, b.Hash, b.Work().Bytes())
+			reindex_utxo(tx)
 			return nil
 		}
-		last_hash := bucket.Get([]byte("l"))
-		last_data := bucket.Get(last_hash)
-		last_block := Deserialize(last_data)
-		// Nakamoto
-		if last_block.Height < b.Height {
-			err = bucket.Put([]byte("l"), b.Hash)
+		tx.PutBlock(b)
+		last_hash := tx.Tip()
+		last_work := chain_work(tx, last_hash)
+		work := new(big.Int).Add(chain_work(tx, b.PrevHash), b.Work())
+		tx.Put(WORK_INDEX, b.Hash, work.Bytes())
+		// Nakamoto: the branch with the most total work wins, and on a tie the branch seen first (the tip) stays
+		if work.Cmp(last_work) > 0 {
+			tx.SetTip(b.Hash)
 			fmt.Printf("New block extends the chain\n")//////////////////////////////
-		} else if last_block.Height == b.Height {
-			fmt.Printf("New block branches the chain: \n")//////////////////////////////////
-			if last_block.Time > b.Time {
-				fmt.Printf("\tChoose new block (created earlier)\n")////////////////////////////////
-				err = bucket.Put([]byte("l"), b.Hash)
-			} else if last_block.Time == b.Time {
-				if bytes.Compare(last_block.Hash, b.Hash) == -1 {
-					fmt.Print("\tChoose new block (larger hash)\n")//////////////////////////////////////
-					err = bucket.Put([]byte("l"), b.Hash)
-				}
-			}
+		} else if work.Cmp(last_work) == 0 && bytes.Compare(b.Hash, last_hash) != 0 {
+			fmt.Printf("New block branches the chain: keep the tip (seen first)\n")//////////////////////////////////
+		}
+		if bytes.Compare(tx.Tip(), last_hash) == 0 {
+			return nil
+		}
+		if bytes.Compare(b.PrevHash, last_hash) == 0 {
+			connect_utxo(tx, b)
+		} else {
+			event = reorg(tx, last_hash, b.Hash)
 		}
-		// err = bucket.Put([]byte("l"), b.Hash)
-		if err != nil {
-			log.Panic(err)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if rejected {
+		fmt.Printf("Invalid block: the chain already has another genisis\n")
+		return false
+	}
+	if event != nil {
+		for _, handler := range bc.reorg_handlers {
+			handler(event)
 		}
+	}
+	return true
+}
+
+// Return the hash of the genisis, nil if the chain is empty
+func (bc *BlockChain) Genesis() []byte {
+	var genesis []byte
+	err := bc.Store.View(func (tx StoreTx) error {
+		genesis = tx.Get(META_INDEX, []byte("genesis"))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return genesis
+}
+
+// Return the block of hash `hash` on any branch, nil if it doesn't exist
+func (bc *BlockChain) GetBlock(hash []byte) *Block {
+	var b *Block
+	err := bc.Store.View(func (tx StoreTx) error {
+		b = tx.GetBlock(hash)
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+	return b
+}
+
+func (bc *BlockChain) HasBlock(hash []byte) bool {
+	return bc.GetBlock(hash) != nil
 }
 
 func (bc *BlockChain) PrintBlockChain() string {
@@ -107,4 +267,51 @@ func (bc *BlockChain) PrintBlockChain() string {
 		}
 	}
 	return strings.Join(string_bc, "\n")
-}
\ No newline at end of file
+}
+// The addresses that appear on the main chain, as the recipient of a payment or the initiator of a tx
+// (to restore the HD wallets of a seed, see wallet/hd.go)
+func (bc *BlockChain) Addresses() map[string]bool {
+	addrs := make(map[string]bool)
+	if bc.Tip() == nil {
+		return addrs
+	}
+	iter := NewBlockChainIterator(bc)
+	for {
+		cur_block := iter.Next()
+		for _, tx := range cur_block.Txs {
+			if !tx.IsReward {
+				addrs[string(utils.PKToAdress(tx.Initiator))] = true
+			}
+			for _, out := range tx.Payments {
+				addrs[string(out.Recipient)] = true
+			}
+		}
+		if cur_block.IsGenisis {
+			break
+		}
+	}
+	return addrs
+}
+
+// The total work of the branch ending at `hash`
+// The work of a block is computed from its prevhash if it is not in the "work" index (stored before the index existed)
+func chain_work(tx StoreTx, hash []byte) *big.Int {
+	if data := tx.Get(WORK_INDEX, hash); data != nil {
+		return new(big.Int).SetBytes(data)
+	}
+	b := get_block(tx, hash)
+	if b.IsGenisis {
+		return b.Work()
+	}
+	return new(big.Int).Add(chain_work(tx, b.PrevHash), b.Work())
+}
+
+func index_empty(tx StoreTx, index string) bool {
+	empty := true
+	stop := errors.New("stop")
+	tx.ForEach(index, func(k, v []byte) error {
+		empty = false
+		return stop
+	})
+	return empty
+}
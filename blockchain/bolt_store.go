@@ -0,0 +1,141 @@
+package blockchain
+
+import (
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A BoltStore is a ChainStore on a bolt db.
+// Layout of the db:
+// - "blocks" bucket: hash -> block, and "l" -> hash of the tip
+// - one bucket per index, created on its first Put
+
+type BoltStore struct {
+	DB *bolt.DB
+}
+
+type bolt_tx struct {
+	tx *bolt.Tx
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("blocks"))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{
+		DB: db,
+	}, nil
+}
+
+func (s *BoltStore) View(fn func(tx StoreTx) error) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		return fn(bolt_tx{tx})
+	})
+}
+
+func (s *BoltStore) Update(fn func(tx StoreTx) error) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return fn(bolt_tx{tx})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+func (t bolt_tx) GetBlock(hash []byte) *Block {
+	if len(hash) == 0 {
+		return nil
+	}
+	data := t.tx.Bucket([]byte("blocks")).Get(hash)
+	if data == nil {
+		return nil
+	}
+	return Deserialize(data)
+}
+
+func (t bolt_tx) PutBlock(b *Block) {
+	err := t.tx.Bucket([]byte("blocks")).Put(b.Hash, b.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (t bolt_tx) Tip() []byte {
+	return copy_bytes(t.tx.Bucket([]byte("blocks")).Get([]byte("l")))
+}
+
+func (t bolt_tx) SetTip(hash []byte) {
+	err := t.tx.Bucket([]byte("blocks")).Put([]byte("l"), hash)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (t bolt_tx) Get(index string, key []byte) []byte {
+	bucket := t.tx.Bucket([]byte(index))
+	if bucket == nil {
+		return nil
+	}
+	return copy_bytes(bucket.Get(key))
+}
+
+func (t bolt_tx) Put(index string, key []byte, value []byte) {
+	bucket, err := t.tx.CreateBucketIfNotExists([]byte(index))
+	if err != nil {
+		log.Panic(err)
+	}
+	err = bucket.Put(key, value)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (t bolt_tx) Delete(index string, key []byte) {
+	bucket := t.tx.Bucket([]byte(index))
+	if bucket == nil {
+		return
+	}
+	err := bucket.Delete(key)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (t bolt_tx) ForEach(index string, fn func(key []byte, value []byte) error) error {
+	bucket := t.tx.Bucket([]byte(index))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		return fn(copy_bytes(k), copy_bytes(v))
+	})
+}
+
+func (t bolt_tx) Clear(index string) {
+	err := t.tx.DeleteBucket([]byte(index))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		log.Panic(err)
+	}
+}
+
+// Copy a slice read from the db, see README
+func copy_bytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	res := make([]byte, len(data))
+	copy(res, data)
+	return res
+}
@@ -0,0 +1,203 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// A ChainParams stores the rules that can differ between chains, so that nodes of different chains can run the same binary:
+// - Name: the name of the chain, recorded in the db so that a db is never opened with the rules of another chain
+// - GenesisHash: the hash of the only genisis accepted by the chain (the first genisis seen if empty, see genesis.go)
+//   MainnetParams pins the genisis built from genesis/mainnet.json; the other presets pin none, unless a config file is given
+// - The subsidy schedule: the coins created by the reward tx of each block
+//		InitialSubsidy: the subsidy of the genisis
+//		HalvingInterval: the subsidy halves every HalvingInterval blocks (never if 0)
+//		TailEmission: the subsidy never falls below TailEmission
+// - CoinbaseMaturity: the payments of a reward tx can only be spent by a block CoinbaseMaturity blocks above it,
+//   so that a spend of a reward is not invalidated when the block of the reward is orphaned by a reorg
+// - The difficulty (see difficulty.go)
+//		TBits: the initial threshold of pow is 1 << (256 - TBits)
+//		MinTBits: the threshold never exceeds 1 << (256 - MinTBits)
+//		RetargetInterval: retarget every RetargetInterval blocks (never if 0)
+//		TargetSpacing: the expected time (s) to mine a block
+//		MaxAdjust: a retarget scales the threshold by at most MaxAdjust (or 1 / MaxAdjust)
+// - The settings of the miners of the chain (not checked by consensus)
+//		Threshold: the number of legal txs a miner waits for before mining a block
+//		Port: the port of the RPC service of the miners
+//		PrepareMoney: the money the prime miner gives to each wallet after the genisis
+//		Txs: the number of txs made by the client of each miner
+// A ChainParams can:
+// - Check that its difficulty is usable (see Validate)
+// - Give the subsidy of a block at some height
+// - Give the coins issued by the blocks up to some height
+// - Tell whether an unspent payment can be spent by a block at some height
+// Presets: MainnetParams (slow and hard, like Bitcoin), RegtestParams (trivial pow, for local runs), ExperimentParams (the experiments in README.md)
+
+type ChainParams struct {
+	Name        string
+	GenesisHash []byte
+
+	InitialSubsidy   Amount
+	HalvingInterval  int
+	TailEmission     Amount
+	CoinbaseMaturity int
+
+	TBits            int
+	MinTBits         int
+	RetargetInterval int
+	TargetSpacing    int
+	MaxAdjust        int
+
+	Threshold    int
+	Port         string
+	PrepareMoney Amount
+	Txs          int
+}
+
+var MainnetParams = &ChainParams{
+	Name:             "mainnet",
+	GenesisHash:      pinned_hash("0000004c3be075a8d79fa3333fc07399d073cc8accd42d6ff500d08540ec7d5f"), // genesis/mainnet.json
+	InitialSubsidy:   50,
+	HalvingInterval:  210000, // issues at most 50 * 210000 * 2 = MAX_MONEY
+	TailEmission:     0,
+	CoinbaseMaturity: 100,
+	TBits:            24,
+	MinTBits:         24,
+	RetargetInterval: 2016,
+	TargetSpacing:    600,
+	MaxAdjust:        4,
+	Threshold:        1,
+	Port:             ":1132",
+	PrepareMoney:     10,
+	Txs:              20,
+}
+
+var RegtestParams = &ChainParams{
+	Name:             "regtest",
+	InitialSubsidy:   50,
+	HalvingInterval:  150,
+	TailEmission:     0,
+	CoinbaseMaturity: 1,
+	TBits:            1,
+	MinTBits:         1,
+	RetargetInterval: 0,
+	TargetSpacing:    1,
+	MaxAdjust:        4,
+	Threshold:        1,
+	Port:             ":1132",
+	PrepareMoney:     10,
+	Txs:              5,
+}
+
+var ExperimentParams = &ChainParams{
+	Name:             "experiment",
+	InitialSubsidy:   100,
+	HalvingInterval:  105000, // issues at most 100 * 105000 * 2 = MAX_MONEY
+	TailEmission:     0,
+	CoinbaseMaturity: 10,
+	TBits:            16, // set 16 when demo
+	MinTBits:         8,
+	RetargetInterval: 10,
+	TargetSpacing:    10,
+	MaxAdjust:        4,
+	Threshold:        1,
+	Port:             ":1132",
+	PrepareMoney:     20, // since the subsidy is 100 and there are 5 wallets (1 for each miner), each miner initially gets 20
+	Txs:              20,
+}
+
+var DefaultParams = ExperimentParams
+
+// The bytes of the pinned hash `s` (hex)
+func pinned_hash(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Return the preset named `name`
+func ParamsByName(name string) (*ChainParams, error) {
+	for _, params := range []*ChainParams{MainnetParams, RegtestParams, ExperimentParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown chain %q, expect mainnet, regtest or experiment", name)
+}
+
+// Return an error if the difficulty of `p` cannot be used:
+// TBits and MinTBits must be in 1..255 with MinTBits <= TBits (a threshold of 0 gives no work, and a threshold
+// above 2^255 is easier than the easiest allowed), RetargetInterval must be 0 or at least 2 (a retarget measures the
+// time of RetargetInterval - 1 blocks), and a retargeting chain needs MaxAdjust and TargetSpacing of at least 1
+func (p *ChainParams) Validate() error {
+	if p.TBits < 1 || p.TBits > 255 {
+		return fmt.Errorf("chain %s: TBits is %d, expect 1 to 255", p.Name, p.TBits)
+	}
+	if p.MinTBits < 1 || p.MinTBits > p.TBits {
+		return fmt.Errorf("chain %s: MinTBits is %d, expect 1 to TBits (%d)", p.Name, p.MinTBits, p.TBits)
+	}
+	if p.RetargetInterval < 0 || p.RetargetInterval == 1 {
+		return fmt.Errorf("chain %s: RetargetInterval is %d, expect 0 or at least 2", p.Name, p.RetargetInterval)
+	}
+	if p.RetargetInterval > 0 && p.MaxAdjust < 1 {
+		return fmt.Errorf("chain %s: MaxAdjust is %d, expect at least 1", p.Name, p.MaxAdjust)
+	}
+	if p.RetargetInterval > 0 && p.TargetSpacing < 1 {
+		return fmt.Errorf("chain %s: TargetSpacing is %d, expect at least 1", p.Name, p.TargetSpacing)
+	}
+	return nil
+}
+
+func (p *ChainParams) Subsidy(height int) Amount {
+	subsidy := p.InitialSubsidy
+	if p.HalvingInterval > 0 {
+		halvings := height / p.HalvingInterval
+		if halvings >= 64 {
+			subsidy = 0
+		} else {
+			subsidy >>= uint(halvings)
+		}
+	}
+	if subsidy < p.TailEmission {
+		subsidy = p.TailEmission
+	}
+	return subsidy
+}
+
+// The sum of the subsidies of the blocks of height 0 to `height`, at most MAX_MONEY
+func (p *ChainParams) Issuance(height int) Amount {
+	issued := Amount(0)
+	for start := 0; start <= height; {
+		// The blocks from `start` to `end` have the same subsidy
+		end := height
+		if p.HalvingInterval > 0 && start/p.HalvingInterval < 64 {
+			era_end := (start/p.HalvingInterval+1)*p.HalvingInterval - 1
+			if era_end < end {
+				end = era_end
+			}
+		}
+		subsidy := p.Subsidy(start)
+		blocks := Amount(end - start + 1)
+		if subsidy != 0 && blocks > MAX_MONEY/subsidy {
+			return MAX_MONEY
+		}
+		var ok bool
+		issued, ok = AddAmounts(issued, subsidy*blocks)
+		if !ok {
+			return MAX_MONEY
+		}
+		start = end + 1
+	}
+	return issued
+}
+
+// Whether `unspent` can be spent by a block at `height`
+// The reward of the genisis is the initial money of the chain (distributed by the prime miner), so it is always mature
+func (p *ChainParams) Mature(unspent UnspentOut, height int) bool {
+	if !unspent.IsReward || unspent.Height == 0 {
+		return true
+	}
+	return height-unspent.Height >= p.CoinbaseMaturity
+}
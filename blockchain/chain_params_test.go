@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"testing"
+
+	"Project2/utils"
+)
+
+func TestValidate(t *testing.T) {
+	for _, params := range []*ChainParams{MainnetParams, RegtestParams, ExperimentParams} {
+		if err := params.Validate(); err != nil {
+			t.Errorf("preset %s: %v", params.Name, err)
+		}
+	}
+	cases := []struct {
+		name string
+		edit func(p *ChainParams)
+		ok   bool
+	}{
+		{"TBits 0", func(p *ChainParams) { p.TBits = 0 }, false},
+		{"TBits 256", func(p *ChainParams) { p.TBits = 256 }, false},
+		{"TBits 255", func(p *ChainParams) { p.TBits, p.MinTBits = 255, 255 }, true},
+		{"MinTBits 0", func(p *ChainParams) { p.MinTBits = 0 }, false},
+		{"MinTBits above TBits", func(p *ChainParams) { p.MinTBits = p.TBits + 1 }, false},
+		{"RetargetInterval 1", func(p *ChainParams) { p.RetargetInterval = 1 }, false},
+		{"RetargetInterval 2", func(p *ChainParams) { p.RetargetInterval = 2 }, true},
+		{"RetargetInterval -1", func(p *ChainParams) { p.RetargetInterval = -1 }, false},
+		{"MaxAdjust 0", func(p *ChainParams) { p.MaxAdjust = 0 }, false},
+		{"MaxAdjust 0 without retarget", func(p *ChainParams) { p.MaxAdjust, p.RetargetInterval = 0, 0 }, true},
+		{"TargetSpacing 0", func(p *ChainParams) { p.TargetSpacing = 0 }, false},
+	}
+	for _, c := range cases {
+		params := *ExperimentParams
+		c.edit(&params)
+		if err := params.Validate(); (err == nil) != c.ok {
+			t.Errorf("%s: Validate returns %v, expect ok %v", c.name, err, c.ok)
+		}
+	}
+}
+
+// The subsidies of a preset sum to at most MAX_MONEY, however long the chain grows
+func TestPresetsIssueAtMostMaxMoney(t *testing.T) {
+	for _, params := range []*ChainParams{MainnetParams, RegtestParams, ExperimentParams} {
+		if params.TailEmission != 0 || params.HalvingInterval <= 0 {
+			t.Errorf("preset %s issues coins forever", params.Name)
+			continue
+		}
+		total := uint64(0) // not capped, unlike Issuance
+		for halvings := 0; halvings < 64; halvings++ {
+			total += uint64(params.InitialSubsidy>>uint(halvings)) * uint64(params.HalvingInterval)
+		}
+		if total > uint64(MAX_MONEY) {
+			t.Errorf("preset %s issues %d, more than MAX_MONEY %d", params.Name, total, MAX_MONEY)
+		}
+	}
+}
+
+func TestMature(t *testing.T) {
+	params := *RegtestParams
+	params.CoinbaseMaturity = 10
+	cases := []struct {
+		name    string
+		unspent UnspentOut
+		height  int
+		mature  bool
+	}{
+		{"reward spent CoinbaseMaturity-1 blocks later", UnspentOut{Height: 5, IsReward: true}, 14, false},
+		{"reward spent CoinbaseMaturity blocks later", UnspentOut{Height: 5, IsReward: true}, 15, true},
+		{"reward spent after CoinbaseMaturity blocks", UnspentOut{Height: 5, IsReward: true}, 16, true},
+		{"reward spent in the next block", UnspentOut{Height: 5, IsReward: true}, 6, false},
+		{"genisis reward", UnspentOut{Height: 0, IsReward: true}, 1, true},
+		{"payment", UnspentOut{Height: 5}, 6, true},
+	}
+	for _, c := range cases {
+		if mature := params.Mature(c.unspent, c.height); mature != c.mature {
+			t.Errorf("%s: Mature = %v, expect %v", c.name, mature, c.mature)
+		}
+		// A block at `c.height` can spend the payment only if it is mature
+		initiator := append([]byte{0x02}, make([]byte, 32)...)
+		unspent := c.unspent
+		unspent.Out = Out{Amount: 50, Recipient: utils.PKToAdress(initiator)}
+		view := map_view{Outpoint([]byte("tx"), 0): unspent}
+		tx := &Transaction{Initiator: initiator, Incomes: []In{{HashTx: []byte("tx"), Idx: 0, Amount: 50}}}
+		if _, ok := tx.verify_incomes(view, c.height, &params); ok != c.mature {
+			t.Errorf("%s: verify_incomes = %v, expect %v", c.name, ok, c.mature)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package blockchain
+
+// A ChainStore is where a BlockChain keeps its data. It stores:
+// - Blocks: hash -> block (on every branch)
+// - Tip: the hash of the tip of the main chain
+// - Indexes: named key-value maps derived from the blocks ("utxo", "undo", "meta", ...)
+// A ChainStore can:
+// - Run a read-only store tx (View)
+// - Run a read-write store tx (Update): either all writes of the store tx happen or none
+//   (the store tx is rolled back if `fn` returns an error or panics)
+// Implementations:
+// - BoltStore: a bolt db on disk (bolt_store.go)
+// - MemoryStore: maps in memory, for tests and simulations (memory_store.go)
+
+type ChainStore interface {
+	View(fn func(tx StoreTx) error) error
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// A StoreTx is only valid inside the View/Update that gives it.
+// Every []byte it returns is a copy and can be used after the store tx ends.
+// Failures of the underlying storage panic, as everywhere else in the blockchain.
+type StoreTx interface {
+	GetBlock(hash []byte) *Block // nil if the block doesn't exist
+	PutBlock(b *Block)
+	Tip() []byte // nil if the chain is empty
+	SetTip(hash []byte)
+
+	// Index ops
+	Get(index string, key []byte) []byte // nil if the key doesn't exist
+	Put(index string, key []byte, value []byte)
+	Delete(index string, key []byte)
+	ForEach(index string, fn func(key []byte, value []byte) error) error // in the order of the keys
+	Clear(index string)
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"Project2/utils"
+)
+
+// The pow threshold of a block is stored in its header (Bits, in compact form, see utils/compact.go)
+// The threshold of a block is decided by its height (with the difficulty of the ChainParams of the chain):
+// - The genisis uses the initial threshold 1 << (256 - TBits)
+// - Every RetargetInterval blocks, the threshold is scaled by (actual time) / (expected time) of the
+//   last RetargetInterval blocks, where the expected time is TargetSpacing per block.
+//   The scale is clamped to [1/MaxAdjust, MaxAdjust], and the threshold never exceeds 1 << (256 - MinTBits).
+// - Other blocks use the threshold of their previous block
+// So the time to mine a block stays around TargetSpacing as miners join or leave.
+// The Time of a block must be later than the Time of its previous block, and not too far in the future.
+
+const MAX_FUTURE_TIME = 2 * 3600 // a block can be at most 2h ahead of the clock of the verifier
+
+func (p *ChainParams) initial_bits() uint32 {
+	return utils.BigToCompact(new(big.Int).Lsh(big.NewInt(1), uint(256-p.TBits)))
+}
+
+// The Bits of the block after `prev`
+func (p *ChainParams) next_bits(tx StoreTx, prev *Block) uint32 {
+	height := prev.Height + 1
+	if p.RetargetInterval <= 0 || height%p.RetargetInterval != 0 {
+		return prev.Bits
+	}
+	first := prev
+	for first.Height > height-p.RetargetInterval {
+		first = get_block(tx, first.PrevHash)
+	}
+	expected := int64(prev.Height-first.Height) * int64(p.TargetSpacing) * int64(time.Second)
+	actual := prev.Time - first.Time
+	max_adjust := int64(p.MaxAdjust)
+	if actual < expected/max_adjust {
+		actual = expected / max_adjust
+	}
+	if actual > expected*max_adjust {
+		actual = expected * max_adjust
+	}
+	threshold := utils.CompactToBig(prev.Bits)
+	threshold.Mul(threshold, big.NewInt(actual))
+	threshold.Div(threshold, big.NewInt(expected))
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(256-p.MinTBits))
+	if threshold.Cmp(limit) > 0 {
+		threshold = limit
+	}
+	bits := utils.BigToCompact(threshold)
+	fmt.Printf("Retarget at height %d: %d ns for %d blocks, bits %08x -> %08x\n", height, prev.Time-first.Time, prev.Height-first.Height, prev.Bits, bits)
+	return bits
+}
+
+func (b *Block) verify_bits_and_time(bc *BlockChain) bool {
+	if b.Time > time.Now().UnixNano()+int64(MAX_FUTURE_TIME*time.Second) {
+		fmt.Printf("verify_bits_and_time: block is too far in the future\n")
+		return false
+	}
+	if b.IsGenisis {
+		if b.Bits != bc.Params.initial_bits() {
+			fmt.Printf("verify_bits_and_time: wrong bits of genisis\n")
+			return false
+		}
+		return true
+	}
+	res := true
+	err := bc.Store.View(func(tx StoreTx) error {
+		prev := get_block(tx, b.PrevHash)
+		if b.Time <= prev.Time {
+			fmt.Printf("verify_bits_and_time: block is not later than its prevhash\n")
+			res = false
+		} else if b.Bits != bc.Params.next_bits(tx, prev) {
+			fmt.Printf("verify_bits_and_time: wrong bits %08x\n", b.Bits)
+			res = false
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return res
+}
@@ -0,0 +1,307 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The canonical encoding of txs and blocks, used to hash, sign, store and send them
+// (instead of gob, whose output carries type information and is not promised to be stable).
+// Every encoding starts with ENCODING_VERSION (1B). Integers are big-endian and fixed-width,
+// byte strings and lists are prefixed with their length (uvarint).
+//
+// In:			HashTx (bytes) | Idx (4B) | Amount (8B)
+// Out:			Amount (8B) | Recipient (bytes)
+// Unsigned tx:	version | Initiator (bytes) | #Incomes (uvarint) | In... | #Payments (uvarint) | Out... | IsReward (1B) | Height (8B)
+// Transaction:	unsigned tx | Signature (bytes) | Hash (bytes)
+// Sighash preimage:	"sighash" | unsigned tx
+// Block header:	version | MerkleRoot (bytes) | WitnessRoot (bytes) | PrevHash (bytes) | Time (8B) | Nonce (8B) | Bits (4B) | Height (8B) | IsGenisis (1B)
+// Block:		block header | Hash (bytes) | #Txs (uvarint) | Transaction (bytes)...
+//
+// The hash of a block is SHA256 of its header. The hash (id) of a tx is SHA256 of the unsigned tx, and the
+// initiator signs SHA256 of the sighash preimage (see transaction.go). The signature is left out of both, so
+// the id of a tx never depends on how its signature is encoded; the "sighash" tag keeps the signed hash
+// different from the id. The signatures are committed to by the block instead: the leaves of its WitnessRoot are the
+// witness hashes of its txs, SHA256 of the whole Transaction, so that no signature of a block can be stripped or
+// replaced without changing the hash of the block (the leaves of its MerkleRoot stay the ids of its txs).
+// Decoding rejects unknown versions, truncated data, oversized lengths and trailing bytes,
+// so that a tx or a block has exactly one encoding.
+
+const ENCODING_VERSION = 3
+const MAX_ENCODED_BYTES = 1 << 20 // the longest byte string or list in an encoding
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(n uint8) {
+	e.buf = append(e.buf, n)
+}
+
+func (e *encoder) uint32(n uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, n)
+}
+
+func (e *encoder) uint64(n uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+func (e *encoder) length(n int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(n))
+}
+
+func (e *encoder) bytes(data []byte) {
+	e.length(len(data))
+	e.buf = append(e.buf, data...)
+}
+
+// A decoder keeps the first error, so that a caller only checks it once at the end
+type decoder struct {
+	data []byte
+	err  error
+}
+
+var errTruncated = errors.New("truncated data")
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.err = errTruncated
+		return nil
+	}
+	res := d.data[:n]
+	d.data = d.data[n:]
+	return res
+}
+
+func (d *decoder) uint8() uint8 {
+	data := d.next(1)
+	if data == nil {
+		return 0
+	}
+	return data[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	data := d.next(4)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func (d *decoder) uint64() uint64 {
+	data := d.next(8)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+func (d *decoder) bool() bool {
+	b := d.uint8()
+	if b > 1 && d.err == nil {
+		d.err = fmt.Errorf("invalid bool %d", b)
+	}
+	return b == 1
+}
+
+func (d *decoder) length() int {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	if n > MAX_ENCODED_BYTES {
+		d.err = fmt.Errorf("length %d exceeds %d", n, MAX_ENCODED_BYTES)
+		return 0
+	}
+	// The shortest uvarint only, so that a length has one encoding
+	if size != len(binary.AppendUvarint(nil, n)) {
+		d.err = fmt.Errorf("non-canonical length")
+		return 0
+	}
+	d.data = d.data[size:]
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	data := d.next(n)
+	if data == nil {
+		return []byte{}
+	}
+	return append([]byte{}, data...)
+}
+
+func (d *decoder) version() {
+	v := d.uint8()
+	if v != ENCODING_VERSION && d.err == nil {
+		d.err = fmt.Errorf("unknown encoding version %d", v)
+	}
+}
+
+// Check that all data is decoded
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+const SIGHASH_TAG = "sighash"
+
+func (tx *Transaction) encode_unsigned_to(e *encoder) {
+	e.uint8(ENCODING_VERSION)
+	e.bytes(tx.Initiator)
+	e.length(len(tx.Incomes))
+	for _, in := range tx.Incomes {
+		e.bytes(in.HashTx)
+		e.uint32(uint32(in.Idx))
+		e.uint64(uint64(in.Amount))
+	}
+	e.length(len(tx.Payments))
+	for _, out := range tx.Payments {
+		e.uint64(uint64(out.Amount))
+		e.bytes(out.Recipient)
+	}
+	e.bool(tx.IsReward)
+	e.uint64(uint64(tx.Height))
+}
+
+func (tx *Transaction) encode_unsigned() []byte {
+	e := &encoder{}
+	tx.encode_unsigned_to(e)
+	return e.buf
+}
+
+func (tx *Transaction) encode_sighash_preimage() []byte {
+	e := &encoder{
+		buf: []byte(SIGHASH_TAG),
+	}
+	tx.encode_unsigned_to(e)
+	return e.buf
+}
+
+func (tx *Transaction) Encode() []byte {
+	e := &encoder{}
+	tx.encode_unsigned_to(e)
+	e.bytes(tx.Signature)
+	e.bytes(tx.Hash)
+	return e.buf
+}
+
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	d := &decoder{data: data}
+	d.version()
+	tx := &Transaction{
+		Initiator: d.bytes(),
+		Incomes:   []In{},
+		Payments:  []Out{},
+	}
+	n := d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		tx.Incomes = append(tx.Incomes, In{
+			HashTx: d.bytes(),
+			Idx:    int(d.uint32()),
+			Amount: Amount(d.uint64()),
+		})
+	}
+	n = d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		tx.Payments = append(tx.Payments, Out{
+			Amount:    Amount(d.uint64()),
+			Recipient: d.bytes(),
+		})
+	}
+	tx.IsReward = d.bool()
+	tx.Height = int(d.uint64())
+	tx.Signature = d.bytes()
+	tx.Hash = d.bytes()
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("fail to decode tx: %v", err)
+	}
+	return tx, nil
+}
+
+func (b *Block) encode_header(e *encoder) {
+	e.bytes(b.MerkleRoot)
+	e.bytes(b.WitnessRoot)
+	e.bytes(b.PrevHash)
+	e.uint64(uint64(b.Time))
+	e.uint64(uint64(b.Nonce))
+	e.uint32(b.Bits)
+	e.uint64(uint64(b.Height))
+	e.bool(b.IsGenisis)
+}
+
+func (b *Block) decode_header(d *decoder) {
+	b.MerkleRoot = d.bytes()
+	b.WitnessRoot = d.bytes()
+	b.PrevHash = d.bytes()
+	b.Time = int64(d.uint64())
+	b.Nonce = int(d.uint64())
+	b.Bits = d.uint32()
+	b.Height = int(d.uint64())
+	b.IsGenisis = d.bool()
+}
+
+// The encoding of the header of the block, whose hash is the hash of the block
+func (b *Block) EncodeHeader() []byte {
+	e := &encoder{}
+	e.uint8(ENCODING_VERSION)
+	b.encode_header(e)
+	return e.buf
+}
+
+func (b *Block) Encode() []byte {
+	e := &encoder{}
+	e.uint8(ENCODING_VERSION)
+	b.encode_header(e)
+	e.bytes(b.Hash)
+	e.length(len(b.Txs))
+	for _, tx := range b.Txs {
+		e.bytes(tx.Encode())
+	}
+	return e.buf
+}
+
+func DecodeBlock(data []byte) (*Block, error) {
+	d := &decoder{data: data}
+	d.version()
+	b := &Block{}
+	b.decode_header(d)
+	b.Hash = d.bytes()
+	b.Txs = []*Transaction{}
+	n := d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		tx_data := d.bytes()
+		if d.err != nil {
+			break
+		}
+		tx, err := DecodeTransaction(tx_data)
+		if err != nil {
+			d.err = fmt.Errorf("tx %d: %v", i, err)
+			break
+		}
+		b.Txs = append(b.Txs, tx)
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("fail to decode block: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Golden vectors: the encodings and hashes of fixed values must never change,
+// since they are stored on disk, sent to other nodes and hashed into ids and blocks
+
+const golden_unsigned = "03" + // version
+	"03021122" + // Initiator
+	"01" + "02aabb" + "00000001" + "0000000000000007" + // 1 income
+	"02" + "0000000000000005" + "027231" + "0000000000000001" + "027232" + // 2 payments
+	"00" + // IsReward
+	"0000000000000000" // Height
+
+const golden_txid = "4f94add48c67da15faa152909dda1c4a2adc77b5f047086817234ad7016d339a"
+const golden_sighash = "58a620fb0ae79b2386109049c91630db5d70e13b258c6c79a645987e32e5c233"
+const golden_tx_encoding = golden_unsigned + "025152" + "20" + golden_txid
+const golden_witness_hash = "adb1c46651f7c566917c0ea240c000cd095362adabb9571f2d55bd5d8e29f431"
+
+const golden_merkle_root = "369d014bd389a56faf83573d3180562e67061cb6e414dc904143601b71007552"
+const golden_witness_root = "fd78bf443f88f855cf476793af4724065bf8c54220b592e49a47b5deb4a20d76"
+const golden_header = "03" + // version
+	"20" + golden_merkle_root +
+	"20" + golden_witness_root +
+	"03010203" + // PrevHash
+	"00000000000003e8" + // Time
+	"000000000000002a" + // Nonce
+	"1f00ffff" + // Bits
+	"0000000000000003" + // Height
+	"00" // IsGenisis
+const golden_block_hash = "be4da725d195e179d8d38c77c78e19d98ab21f59405c919df47e7ae6f47508a9"
+const golden_block_encoding = golden_header + "20" + golden_block_hash + "01" + "59" + golden_tx_encoding
+
+func golden_tx() *Transaction {
+	return &Transaction{
+		Initiator: []byte{0x02, 0x11, 0x22},
+		Incomes: []In{
+			{HashTx: []byte{0xaa, 0xbb}, Idx: 1, Amount: 7},
+		},
+		Payments: []Out{
+			{Amount: 5, Recipient: []byte("r1")},
+			{Amount: 1, Recipient: []byte("r2")},
+		},
+		Signature: []byte{0x51, 0x52},
+	}
+}
+
+func golden_block() *Block {
+	tx := golden_tx()
+	tx.Hash = tx.txid()
+	b := &Block{
+		Txs:      []*Transaction{tx},
+		PrevHash: []byte{0x01, 0x02, 0x03},
+		Time:     1000,
+		Nonce:    42,
+		Bits:     0x1f00ffff,
+		Height:   3,
+	}
+	b.HashTxs()
+	b.Hash = b.mid_hash()
+	return b
+}
+
+func must_decode_hex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func check_hex(t *testing.T, name string, got []byte, expect string) {
+	if hex.EncodeToString(got) != expect {
+		t.Errorf("%s is %x, expect %s", name, got, expect)
+	}
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	tx := golden_tx()
+	check_hex(t, "unsigned tx", tx.encode_unsigned(), golden_unsigned)
+	check_hex(t, "txid", tx.txid(), golden_txid)
+	check_hex(t, "sighash preimage", tx.encode_sighash_preimage(), hex.EncodeToString([]byte(SIGHASH_TAG))+golden_unsigned)
+	check_hex(t, "sighash", tx.SigHash(), golden_sighash)
+	tx.Hash = tx.txid()
+	check_hex(t, "tx", tx.Encode(), golden_tx_encoding)
+	check_hex(t, "witness hash", tx.WitnessHash(), golden_witness_hash)
+
+	decoded, err := DecodeTransaction(must_decode_hex(t, golden_tx_encoding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), tx.Encode()) || decoded.Incomes[0].Amount != 7 || decoded.Payments[1].Amount != 1 {
+		t.Errorf("decoded tx %+v, expect %+v", decoded, tx)
+	}
+	// The signature is left out of the id, and not of the witness hash
+	tx.Signature = []byte{0x51, 0x53}
+	check_hex(t, "txid of another signature", tx.txid(), golden_txid)
+	if hex.EncodeToString(tx.WitnessHash()) == golden_witness_hash {
+		t.Errorf("witness hash does not depend on the signature")
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	b := golden_block()
+	check_hex(t, "merkle root", b.MerkleRoot, golden_merkle_root)
+	check_hex(t, "witness root", b.WitnessRoot, golden_witness_root)
+	check_hex(t, "header", b.EncodeHeader(), golden_header)
+	check_hex(t, "block hash", b.Hash, golden_block_hash)
+	check_hex(t, "block", b.Encode(), golden_block_encoding)
+
+	decoded, err := DecodeBlock(must_decode_hex(t, golden_block_encoding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), b.Encode()) || !decoded.verify_merkle_root() {
+		t.Errorf("decoded block %+v, expect %+v", decoded, b)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	// The IsReward byte of the tx is followed by Height (8B), Signature and Hash
+	is_reward := len(golden_unsigned) - 18
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated", golden_tx_encoding[:len(golden_tx_encoding)-2]},
+		{"truncated length", golden_tx_encoding[:2] + "83"},
+		{"trailing bytes", golden_tx_encoding + "00"},
+		{"non-canonical uvarint", golden_tx_encoding[:2] + "8300" + golden_tx_encoding[4:]},
+		{"bool > 1", golden_tx_encoding[:is_reward] + "02" + golden_tx_encoding[is_reward+2:]},
+		{"unknown version", "01" + golden_tx_encoding[2:]},
+		{"oversized length", golden_tx_encoding[:2] + "ffffffff0f" + golden_tx_encoding[4:]},
+	}
+	for _, c := range cases {
+		if _, err := DecodeTransaction(must_decode_hex(t, c.data)); err == nil {
+			t.Errorf("tx %s: decoded, expect an error", c.name)
+		}
+	}
+
+	// The IsGenisis byte ends the header
+	is_genisis := len(golden_header) - 2
+	block_cases := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated", golden_block_encoding[:len(golden_block_encoding)-2]},
+		{"trailing bytes", golden_block_encoding + "00"},
+		{"non-canonical uvarint", golden_block_encoding[:2] + "a000" + golden_block_encoding[4:]},
+		{"bool > 1", golden_block_encoding[:is_genisis] + "02" + golden_block_encoding[is_genisis+2:]},
+		{"unknown version", "02" + golden_block_encoding[2:]},
+		{"tx with trailing bytes", strings.Replace(golden_block_encoding, "59"+golden_tx_encoding, "5a"+golden_tx_encoding+"00", 1)},
+		{"tx of unknown version", strings.Replace(golden_block_encoding, "59"+golden_tx_encoding, "59"+"01"+golden_tx_encoding[2:], 1)},
+	}
+	for _, c := range block_cases {
+		if _, err := DecodeBlock(must_decode_hex(t, c.data)); err == nil {
+			t.Errorf("block %s: decoded, expect an error", c.name)
+		}
+	}
+}
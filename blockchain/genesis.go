@@ -0,0 +1,103 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"Project2/utils"
+)
+
+// A GenesisConfig stores the genisis of a chain, so that every miner builds the same genisis by itself
+// (instead of the prime miner mining a genisis and paying the initial money to everyone):
+// - Time: the time of the genisis (unix seconds)
+// - Allocations: the initial money of each address, paid by the reward tx of the genisis
+// The config is a JSON file, e.g.
+//		{"time": 1700000000, "allocations": [{"address": "1A1zP1...", "amount": 20}, ...]}
+// The allocations can sum to at most the subsidy of the genisis.
+// The genisis built from a config is deterministic: the reward tx has no initiator (and a reward has no signature),
+// and the pow is found by trying nonces from 0, so its hash can be pinned in the ChainParams.
+
+type GenesisAllocation struct {
+	Address string `json:"address"`
+	Amount  Amount `json:"amount"`
+}
+
+type GenesisConfig struct {
+	Time        int64               `json:"time"`
+	Allocations []GenesisAllocation `json:"allocations"`
+}
+
+func LoadGenesisConfig(path string) (*GenesisConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read genisis config %s: %v", path, err)
+	}
+	var cfg GenesisConfig
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse genisis config %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// Build the genisis of `cfg` with the rules of `params`
+func NewGenesisBlock(cfg *GenesisConfig, params *ChainParams) (*Block, error) {
+	if len(cfg.Allocations) == 0 {
+		return nil, fmt.Errorf("genisis config has no allocation")
+	}
+	reward := &Transaction{
+		Initiator: []byte{},
+		Incomes:   []In{},
+		Payments:  []Out{},
+		IsReward:  true,
+		Hash:      []byte{},
+		Signature: []byte{},
+	}
+	total := Amount(0)
+	for aid, alloc := range cfg.Allocations {
+		addr, err := utils.ParseAddress(alloc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("allocation %d: %v", aid, err)
+		}
+		if alloc.Amount == 0 {
+			return nil, fmt.Errorf("allocation %d: zero amount", aid)
+		}
+		var ok bool
+		total, ok = AddAmounts(total, alloc.Amount)
+		if !ok {
+			return nil, fmt.Errorf("allocation %d: sum of allocations exceeds MAX_MONEY", aid)
+		}
+		reward.Payments = append(reward.Payments, Out{
+			Amount:    alloc.Amount,
+			Recipient: addr.Bytes(),
+		})
+	}
+	if total > params.Subsidy(0) {
+		return nil, fmt.Errorf("allocations sum to %d, more than the subsidy of the genisis %d", total, params.Subsidy(0))
+	}
+	reward.HashTx()
+
+	genesis := &Block{
+		Txs:         []*Transaction{reward},
+		MerkleRoot:  []byte{},
+		WitnessRoot: []byte{},
+		PrevHash:    []byte{},
+		Time:        cfg.Time * int64(time.Second),
+		Nonce:       0,
+		Bits:        params.initial_bits(),
+		Height:      0,
+		IsGenisis:   true,
+		Hash:        []byte{},
+	}
+	genesis.HashTxs()
+	for {
+		hash := genesis.mid_hash()
+		if genesis.is_acceptable_hash(hash) {
+			genesis.Hash = hash
+			return genesis, nil
+		}
+		genesis.Nonce++
+	}
+}
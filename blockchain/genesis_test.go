@@ -0,0 +1,23 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMainnetGenesis(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mines the genisis of mainnet")
+	}
+	cfg, err := LoadGenesisConfig("../genesis/mainnet.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := NewGenesisBlock(cfg, MainnetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(genesis.Hash, MainnetParams.GenesisHash) {
+		t.Errorf("genisis of genesis/mainnet.json is %x, but mainnet pins %x", genesis.Hash, MainnetParams.GenesisHash)
+	}
+}
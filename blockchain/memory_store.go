@@ -0,0 +1,175 @@
+package blockchain
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// A MemoryStore is a ChainStore in memory, so that many chains can run in one process without touching the disk.
+// It stores every value serialized (as the BoltStore does), so that no *Block is shared between store txs.
+// - Concurrency constraints: many Views or one Update at a time
+// - An Update writes in place and keeps an undo log, which is replayed backwards if the Update fails
+
+type MemoryStore struct {
+	lock    sync.RWMutex
+	blocks  map[string][]byte // map: hash -> serialized block
+	tip     []byte
+	indexes map[string]map[string][]byte // map: index -> key -> value
+}
+
+type memory_tx struct {
+	store    *MemoryStore
+	writable bool
+	undo     []func()
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		blocks:  make(map[string][]byte),
+		tip:     nil,
+		indexes: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) View(fn func(tx StoreTx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return fn(&memory_tx{store: s, writable: false})
+}
+
+func (s *MemoryStore) Update(fn func(tx StoreTx) error) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx := &memory_tx{store: s, writable: true}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	err = fn(tx)
+	if err == nil {
+		committed = true
+	}
+	return err
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (t *memory_tx) GetBlock(hash []byte) *Block {
+	data, ok := t.store.blocks[string(hash)]
+	if !ok || len(hash) == 0 {
+		return nil
+	}
+	return Deserialize(data)
+}
+
+func (t *memory_tx) PutBlock(b *Block) {
+	t.check_writable()
+	key := string(b.Hash)
+	old, existed := t.store.blocks[key]
+	t.undo = append(t.undo, func() {
+		if existed {
+			t.store.blocks[key] = old
+		} else {
+			delete(t.store.blocks, key)
+		}
+	})
+	t.store.blocks[key] = b.Serialize()
+}
+
+func (t *memory_tx) Tip() []byte {
+	return copy_bytes(t.store.tip)
+}
+
+func (t *memory_tx) SetTip(hash []byte) {
+	t.check_writable()
+	old := t.store.tip
+	t.undo = append(t.undo, func() {
+		t.store.tip = old
+	})
+	t.store.tip = copy_bytes(hash)
+}
+
+func (t *memory_tx) Get(index string, key []byte) []byte {
+	return copy_bytes(t.store.indexes[index][string(key)])
+}
+
+func (t *memory_tx) Put(index string, key []byte, value []byte) {
+	t.check_writable()
+	if t.store.indexes[index] == nil {
+		t.store.indexes[index] = make(map[string][]byte)
+	}
+	t.set(index, string(key), copy_bytes(value), true)
+}
+
+func (t *memory_tx) Delete(index string, key []byte) {
+	t.check_writable()
+	if t.store.indexes[index] == nil {
+		return
+	}
+	t.set(index, string(key), nil, false)
+}
+
+func (t *memory_tx) ForEach(index string, fn func(key []byte, value []byte) error) error {
+	entries := t.store.indexes[index]
+	var keys []string
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := fn([]byte(key), copy_bytes(entries[key]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memory_tx) Clear(index string) {
+	t.check_writable()
+	old, existed := t.store.indexes[index]
+	t.undo = append(t.undo, func() {
+		if existed {
+			t.store.indexes[index] = old
+		} else {
+			delete(t.store.indexes, index)
+		}
+	})
+	delete(t.store.indexes, index)
+}
+
+// Set (or delete if `present` is false) a key of an existing index, and log how to undo it
+func (t *memory_tx) set(index string, key string, value []byte, present bool) {
+	entries := t.store.indexes[index]
+	old, existed := entries[key]
+	t.undo = append(t.undo, func() {
+		if existed {
+			entries[key] = old
+		} else {
+			delete(entries, key)
+		}
+	})
+	if present {
+		entries[key] = value
+	} else {
+		delete(entries, key)
+	}
+}
+
+func (t *memory_tx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+func (t *memory_tx) check_writable() {
+	if !t.writable {
+		log.Panic("memory_tx: write in a read-only store tx")
+	}
+}
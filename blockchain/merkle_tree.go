@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// A MerkleTree stores:
+// - The levels of the tree: Levels[0] are the (hashed) leaves, the last level is the root
+// The leaves are the hashes of the txs of a block (MerkleRoot), or their witness hashes (WitnessRoot, see Transaction.WitnessHash),
+// in the order of the block.
+// A leaf is hashed as SHA256(0x00 | hash_tx) and an inner node as SHA256(0x01 | left | right),
+// so that a leaf can never be passed off as an inner node.
+// When a level has an odd number of nodes, the last node is promoted to the next level as it is
+// (instead of being paired with a copy of itself), so that two different lists of txs cannot share a root.
+// A MerkleTree can:
+// - Give its root
+// - Give the proof of a leaf: the sibling hashes from the leaf up to the root
+// A proof can be checked against a root without the tree (VerifyMerkleProof)
+
+type MerkleTree struct {
+	Levels [][][]byte
+}
+
+// A step of a merkle proof
+// - Hash: the hash of the sibling node
+// - Left: whether the sibling is on the left
+type MerkleProofNode struct {
+	Hash []byte
+	Left bool
+}
+
+func NewMerkleTree(hashes [][]byte) *MerkleTree {
+	tree := MerkleTree{}
+	if len(hashes) == 0 {
+		root := sha256.Sum256([]byte{})
+		tree.Levels = [][][]byte{[][]byte{root[:]}}
+		return &tree
+	}
+	var level [][]byte
+	for _, hash := range hashes {
+		level = append(level, merkle_leaf(hash))
+	}
+	tree.Levels = append(tree.Levels, level)
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkle_node(level[i], level[i+1]))
+			}
+		}
+		tree.Levels = append(tree.Levels, next)
+		level = next
+	}
+	return &tree
+}
+
+func (t *MerkleTree) Root() []byte {
+	return t.Levels[len(t.Levels)-1][0]
+}
+
+// The proof of the `idx`-th leaf
+func (t *MerkleTree) Proof(idx int) []MerkleProofNode {
+	proof := []MerkleProofNode{}
+	for _, level := range t.Levels[:len(t.Levels)-1] {
+		if idx%2 == 1 {
+			proof = append(proof, MerkleProofNode{
+				Hash: level[idx-1],
+				Left: true,
+			})
+		} else if idx+1 < len(level) {
+			proof = append(proof, MerkleProofNode{
+				Hash: level[idx+1],
+				Left: false,
+			})
+		}
+		idx /= 2
+	}
+	return proof
+}
+
+// Check whether `proof` proves that the tx `hash_tx` is a leaf of the tree whose root is `root`
+// (a tx hash against the MerkleRoot of a block, a witness hash against its WitnessRoot)
+func VerifyMerkleProof(root []byte, hash_tx []byte, proof []MerkleProofNode) bool {
+	hash := merkle_leaf(hash_tx)
+	for _, node := range proof {
+		if node.Left {
+			hash = merkle_node(node.Hash, hash)
+		} else {
+			hash = merkle_node(hash, node.Hash)
+		}
+	}
+	return bytes.Compare(hash, root) == 0
+}
+
+func merkle_leaf(hash_tx []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0x00}, hash_tx...))
+	return hash[:]
+}
+
+func merkle_node(left []byte, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{[]byte{0x01}, left, right}, []byte{}))
+	return hash[:]
+}
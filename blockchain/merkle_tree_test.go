@@ -0,0 +1,66 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A block of `n` txs with different payments and signatures
+func proof_block(n int) *Block {
+	b := &Block{}
+	for i := 0; i < n; i++ {
+		tx := golden_tx()
+		tx.Payments[0].Amount = Amount(i + 1)
+		tx.Signature = []byte{0x51, byte(i)}
+		tx.Hash = tx.txid()
+		b.Txs = append(b.Txs, tx)
+	}
+	b.HashTxs()
+	return b
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 7; n++ {
+		b := proof_block(n)
+		for i, tx := range b.Txs {
+			other := b.Txs[(i+1)%n]
+			proof, ok := b.MerkleProof(tx.Hash)
+			if !ok || !VerifyMerkleProof(b.MerkleRoot, tx.Hash, proof) {
+				t.Errorf("%d txs: tx %d is not proved by its hash", n, i)
+			}
+			if n > 1 && VerifyMerkleProof(b.MerkleRoot, other.Hash, proof) {
+				t.Errorf("%d txs: the proof of tx %d proves another tx", n, i)
+			}
+			proof, ok = b.WitnessProof(tx.WitnessHash())
+			if !ok || !VerifyMerkleProof(b.WitnessRoot, tx.WitnessHash(), proof) {
+				t.Errorf("%d txs: tx %d is not proved by its witness hash", n, i)
+			}
+			if n > 1 && VerifyMerkleProof(b.WitnessRoot, other.WitnessHash(), proof) {
+				t.Errorf("%d txs: the witness proof of tx %d proves another tx", n, i)
+			}
+		}
+	}
+	b := proof_block(3)
+	if _, ok := b.MerkleProof([]byte("not a tx")); ok {
+		t.Errorf("proof of a tx that is not in the block")
+	}
+}
+
+func TestWitnessRootCommitsToSignatures(t *testing.T) {
+	b := proof_block(3)
+	if !b.verify_merkle_root() {
+		t.Fatalf("roots of the block do not verify")
+	}
+	merkle_root, witness_root := b.MerkleRoot, b.WitnessRoot
+	b.Txs[1].Signature = []byte{} // stripped by a relay
+	if b.verify_merkle_root() {
+		t.Errorf("block with a stripped signature verifies")
+	}
+	b.HashTxs()
+	if !bytes.Equal(b.MerkleRoot, merkle_root) {
+		t.Errorf("MerkleRoot depends on the signatures")
+	}
+	if bytes.Equal(b.WitnessRoot, witness_root) {
+		t.Errorf("WitnessRoot does not depend on the signatures")
+	}
+}
@@ -0,0 +1,94 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// A ReorgEvent stores:
+// - The tip before and after the tip switched to another branch
+// - Depth: the number of blocks disconnected from the old branch
+// - The non-reward txs of the disconnected blocks that are not in the new branch
+// A ReorgEvent is given to every handler registered by OnReorg, after the reorg is committed.
+// A reorg (inside the store tx of AppendBlock):
+//		1. Find the fork point of the old tip and the new tip
+//		2. Disconnect the old branch back to the fork point (using the undo data of its blocks)
+//		3. Connect the new branch from the fork point to the new tip
+
+type ReorgEvent struct {
+	OldTip       []byte
+	NewTip       []byte
+	Depth        int
+	Disconnected []*Transaction
+}
+
+// Register `handler` to be called after every reorg
+// Handlers are called by the goroutine that appends the block, so they must not block on it
+func (bc *BlockChain) OnReorg(handler func(*ReorgEvent)) {
+	bc.reorg_handlers = append(bc.reorg_handlers, handler)
+}
+
+// Switch the "utxo" index from the branch ending at `old_tip` to the branch ending at `new_tip`
+func reorg(tx StoreTx, old_tip []byte, new_tip []byte) *ReorgEvent {
+	old_side, new_side := find_fork(tx, old_tip, new_tip)
+	event := &ReorgEvent{
+		OldTip:       old_tip,
+		NewTip:       new_tip,
+		Depth:        len(old_side),
+		Disconnected: []*Transaction{},
+	}
+	for _, cur_block := range old_side {
+		disconnect_utxo(tx, cur_block)
+	}
+	reconnected := make(map[string]bool)
+	for i := len(new_side) - 1; i >= 0; i-- {
+		connect_utxo(tx, new_side[i])
+		for _, cur_tx := range new_side[i].Txs {
+			reconnected[hex.EncodeToString(cur_tx.Hash)] = true
+		}
+	}
+	// Give back the txs from the oldest disconnected block on, so that a tx comes after the txs it spends
+	for i := len(old_side) - 1; i >= 0; i-- {
+		for _, cur_tx := range old_side[i].Txs {
+			if !cur_tx.IsReward && !reconnected[hex.EncodeToString(cur_tx.Hash)] {
+				event.Disconnected = append(event.Disconnected, cur_tx)
+			}
+		}
+	}
+	fmt.Printf("Reorg: disconnect %d blocks, connect %d blocks\n", len(old_side), len(new_side))
+	return event
+}
+
+// Walk back from `a` and `b` to their fork point
+// return the blocks of the branch of `a` after the fork point, from `a` backwards
+// return the blocks of the branch of `b` after the fork point, from `b` backwards
+func find_fork(tx StoreTx, a []byte, b []byte) ([]*Block, []*Block) {
+	a_side := []*Block{}
+	b_side := []*Block{}
+	block_a := get_block(tx, a)
+	block_b := get_block(tx, b)
+	for bytes.Compare(block_a.Hash, block_b.Hash) != 0 {
+		if block_a.Height >= block_b.Height {
+			if block_a.IsGenisis {
+				log.Panic("find_fork: the branches have different genisis")
+			}
+			a_side = append(a_side, block_a)
+			block_a = get_block(tx, block_a.PrevHash)
+		} else {
+			b_side = append(b_side, block_b)
+			block_b = get_block(tx, block_b.PrevHash)
+		}
+	}
+	return a_side, b_side
+}
+
+// Like tx.GetBlock, but the block must exist
+func get_block(tx StoreTx, hash []byte) *Block {
+	b := tx.GetBlock(hash)
+	if b == nil {
+		log.Panic(fmt.Sprintf("get_block: block %x doesn't exist", hash))
+	}
+	return b
+}
@@ -0,0 +1,201 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"Project2/utils"
+)
+
+// A Signer over a fresh key
+type test_key struct {
+	sk *ecdsa.PrivateKey
+}
+
+func new_test_key(t *testing.T) test_key {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test_key{sk}
+}
+
+func (k test_key) PublicKey() []byte {
+	return utils.EncodePublicKey(&k.sk.PublicKey)
+}
+
+func (k test_key) PrivateKey() (*ecdsa.PrivateKey, error) {
+	return k.sk, nil
+}
+
+func (k test_key) address() utils.Address {
+	return utils.Address(utils.PKToAdress(k.PublicKey()))
+}
+
+func new_test_chain(t *testing.T) *BlockChain {
+	bc, err := OpenBlockChainStore(NewMemoryStore(), &Options{Params: RegtestParams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+// Mine a block of `txs` and a reward to `miner` on the tip of `bc`, and append it
+func mine(t *testing.T, bc *BlockChain, miner test_key, txs ...*Transaction) *Block {
+	fees := Amount(0)
+	for _, tx := range txs {
+		fees += tx.Fee()
+	}
+	txs = append(txs, NewTransaction(miner, "", 0, fees, true, bc))
+	b := NewBlock(txs, bc.Height() == -1, bc)
+	if !bc.AppendBlock(b) {
+		t.Fatalf("block %d is rejected", b.Height)
+	}
+	return b
+}
+
+// The "utxo" index (map: hash of a tx -> its unspent payments) and the "undo" index (map: hash of a block -> the payments it spent)
+// The values are decoded, since the gob encoding of a map is not deterministic
+func index_snapshot(t *testing.T, bc *BlockChain) (map[string]*UnspentOuts, map[string][]SpentOut) {
+	utxo := make(map[string]*UnspentOuts)
+	undo := make(map[string][]SpentOut)
+	err := bc.Store.View(func(tx StoreTx) error {
+		err := tx.ForEach(UTXO_INDEX, func(key []byte, value []byte) error {
+			utxo[string(key)] = deserialize_outs(value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(UNDO_INDEX, func(key []byte, value []byte) error {
+			undo[string(key)] = get_undo(tx, key)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return utxo, undo
+}
+
+// The "utxo" and "undo" indexes kept up by AppendBlock must be the ones rebuilt from the main chain
+func check_indexes(t *testing.T, bc *BlockChain, when string) {
+	utxo, undo := index_snapshot(t, bc)
+	UTXOSet{bc}.Reindex()
+	reindexed_utxo, reindexed_undo := index_snapshot(t, bc)
+	if !reflect.DeepEqual(utxo, reindexed_utxo) {
+		t.Errorf("%s: the utxo index differs from a reindex", when)
+	}
+	if !reflect.DeepEqual(undo, reindexed_undo) {
+		t.Errorf("%s: the undo index differs from a reindex", when)
+	}
+}
+
+func TestReorgTwoBranches(t *testing.T) {
+	a, b := new_test_key(t), new_test_key(t)
+	// Both branches are mined on their own chain from the same genisis, then appended to `bc`
+	bc, left, right := new_test_chain(t), new_test_chain(t), new_test_chain(t)
+	genesis := mine(t, left, a)
+	if !right.AppendBlock(genesis) || !bc.AppendBlock(genesis) {
+		t.Fatal("genisis is rejected")
+	}
+	pay := NewTransaction(a, b.address(), 10, 1, false, left)
+	left1 := mine(t, left, a, pay)
+	right1 := mine(t, right, b)
+	right2 := mine(t, right, b)
+	left2 := mine(t, left, a)
+	left3 := mine(t, left, a)
+
+	var events []*ReorgEvent
+	bc.OnReorg(func(event *ReorgEvent) {
+		events = append(events, event)
+	})
+	u := UTXOSet{bc}
+	for _, block := range []*Block{left1, right1} {
+		if !bc.AppendBlock(block) {
+			t.Fatalf("block %d is rejected", block.Height)
+		}
+	}
+	if len(events) != 0 || bytes.Compare(bc.Tip(), left1.Hash) != 0 {
+		t.Fatalf("a branch of the same work switched the tip")
+	}
+	if _, ok := u.Find(genesis.Txs[0].Hash, 0); ok {
+		t.Errorf("the genisis reward spent by %x is unspent", pay.Hash)
+	}
+	_, undo := index_snapshot(t, bc)
+	if spent := undo[string(left1.Hash)]; len(spent) != 1 || bytes.Compare(spent[0].HashTx, genesis.Txs[0].Hash) != 0 || spent[0].Unspent.Out.Amount != 50 {
+		t.Errorf("undo data of left1 is %+v, expect the genisis reward", spent)
+	}
+	check_indexes(t, bc, "before the reorg")
+
+	// right2: the right branch has more work, `pay` is disconnected
+	if !bc.AppendBlock(right2) {
+		t.Fatal("right2 is rejected")
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d reorgs, expect 1", len(events))
+	}
+	event := events[0]
+	if bytes.Compare(event.OldTip, left1.Hash) != 0 || bytes.Compare(event.NewTip, right2.Hash) != 0 {
+		t.Errorf("reorg from %x to %x, expect from %x to %x", event.OldTip, event.NewTip, left1.Hash, right2.Hash)
+	}
+	if event.Depth != 1 {
+		t.Errorf("reorg depth %d, expect 1", event.Depth)
+	}
+	if len(event.Disconnected) != 1 || bytes.Compare(event.Disconnected[0].Hash, pay.Hash) != 0 {
+		t.Errorf("%d txs disconnected, expect only %x", len(event.Disconnected), pay.Hash)
+	}
+	if unspent, ok := u.Find(genesis.Txs[0].Hash, 0); !ok || unspent.Out.Amount != 50 {
+		t.Errorf("the genisis reward is not unspent again")
+	}
+	for idx := range pay.Payments {
+		if _, ok := u.Find(pay.Hash, idx); ok {
+			t.Errorf("payment %d of the disconnected %x is unspent", idx, pay.Hash)
+		}
+	}
+	if balance := u.Balance(a.address().Bytes()); balance != 50 {
+		t.Errorf("balance of a is %d, expect 50", balance)
+	}
+	if balance := u.Balance(b.address().Bytes()); balance != 100 {
+		t.Errorf("balance of b is %d, expect 100", balance)
+	}
+	check_indexes(t, bc, "after the reorg")
+
+	// left3: back to the left branch, `pay` is connected again, and the right branch has only rewards
+	for _, block := range []*Block{left2, left3} {
+		if !bc.AppendBlock(block) {
+			t.Fatalf("block %d is rejected", block.Height)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d reorgs, expect 2", len(events))
+	}
+	event = events[1]
+	if bytes.Compare(event.OldTip, right2.Hash) != 0 || bytes.Compare(event.NewTip, left3.Hash) != 0 {
+		t.Errorf("reorg from %x to %x, expect from %x to %x", event.OldTip, event.NewTip, right2.Hash, left3.Hash)
+	}
+	if event.Depth != 2 {
+		t.Errorf("reorg depth %d, expect 2", event.Depth)
+	}
+	if len(event.Disconnected) != 0 {
+		t.Errorf("%d txs disconnected, expect none", len(event.Disconnected))
+	}
+	if _, ok := u.Find(genesis.Txs[0].Hash, 0); ok {
+		t.Errorf("the genisis reward spent by %x is unspent", pay.Hash)
+	}
+	if unspent, ok := u.Find(pay.Hash, 0); !ok || unspent.Out.Amount != 10 || unspent.Height != 1 {
+		t.Errorf("the payment of %x to b is not unspent at height 1", pay.Hash)
+	}
+	// 39 of change, 51 + 50 + 50 of rewards
+	if balance := u.Balance(a.address().Bytes()); balance != 190 {
+		t.Errorf("balance of a is %d, expect 190", balance)
+	}
+	if balance := u.Balance(b.address().Bytes()); balance != 10 {
+		t.Errorf("balance of b is %d, expect 10", balance)
+	}
+	check_indexes(t, bc, "after the reorg back")
+}
@@ -2,92 +2,138 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 	"log"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/x509"
-	"math/big"
-	"encoding/hex"
 	"fmt"
 	"strings"
 
 	"Project2/utils"
-	"Project2/wallet"
 )
 
 // A Transaction stores:
 // - An address of a wallet: the initiator of this tx
 // - A set of In that represents the incomes of this tx
 // - A set of Out that represents the payments of this tx
-// - A signature by the initiator of this tx
-// - An abstract (hash) of that tx
+// - A signature by the initiator of this tx (none for a reward)
+// - An abstract (hash) of that tx: the id of the tx
 // - Whether this tx is a reward
+// - For a reward: the height of its block, so that two rewards never have the same hash
 // A Transaction can:
-// - Sign: sign the tx
-// - Hash: hash the tx after signing
+// - Sign: sign the sighash of the tx (see encoding.go): the tx without its signature and hash
+//   The signature is fixed-width and low-S (see utils/crypto.go), so that it has exactly one encoding
+// - Hash: hash the tx without its signature, so that re-encoding the signature never changes the id of the tx
+// - Give its fee: incomes - payments, collected by the reward tx of the block
 // - Verify legal tx:
-//		1. Whether the tx's incomes are valid (unspent, belongs to initiator) (no need for reward)
-//		2. Whether the tx's payments are valid (payments <= incomes)
-//		3. Whether the tx's signature is valid
+//		1. Whether the tx's incomes are valid (no duplicates, unspent in the utxo set, mature if paid by a reward, belongs to initiator, amount of the referred payment) (no incomes for reward)
+//		2. Whether the tx's payments are valid (each payment in (0, MAX_MONEY], payments <= the referred payments, see amount.go)
+//		3. Whether the tx's signature is valid (64 bytes, low-S, signs the sighash)
 //		4. Whether the tx's hash is valid
 
-const REWARD = 100 // the reward tx
-
 type In struct {
 	HashTx	[]byte
 	Idx	int
-	Amount	int
+	Amount	Amount
 }
 
 type Out struct {
-	Amount	int
+	Amount	Amount
 	Recipient	[]byte // wallet address
 }
 
 type Transaction struct {
-	Initiator	[]byte // pk
+	Initiator	[]byte // pk, in SEC1 (see utils/crypto.go)
 	Incomes		[]In 
 	Payments	[]Out 
 	IsReward 	bool
+	Height		int // only for a reward
 	Hash		[]byte
 	Signature	[]byte
 }
 
+// The keys of the initiator of a tx (a wallet.Wallet)
+type Signer interface {
+	PublicKey() []byte // in SEC1
+	PrivateKey() (*ecdsa.PrivateKey, error)
+}
+
 // `w`: Initiator's wallet
-// `r`: Recipient's address
+// `r`: Recipient's address (must be valid, see utils.ParseAddress; ignored for a reward)
 // `a`: amount
+// `fee`: the fee paid to the miner of the block. For a reward: the fees of the other txs of the block, claimed with the subsidy
 // `is_reward`: whether this tx is a reward
-func NewTransaction(w *wallet.Wallet, r []byte, a int, is_reward bool, bc *BlockChain) *Transaction {
-	sk, err := x509.ParseECPrivateKey(w.SK)
-	if err != nil {
-		log.Panic(err)
-	}
+func NewTransaction(w Signer, r utils.Address, a Amount, fee Amount, is_reward bool, bc *BlockChain) *Transaction {
+	pk := w.PublicKey()
+	addr := utils.PKToAdress(pk)
 	if is_reward {
+		// The reward is for the block on top of the tip
+		height := bc.Height() + 1
+		reward, ok := AddAmounts(bc.Params.Subsidy(height), fee)
+		if !ok {
+			log.Panic(fmt.Sprintf("ERROR: %s cannot claim %d fees: illegal amount", string(addr), fee))
+		}
 		tx := &Transaction{
-			Initiator: w.PK,
+			Initiator: pk,
 			Incomes: []In{},
 			Payments: []Out{Out{
-				Amount: REWARD,
-				Recipient: w.Address,
+				Amount: reward,
+				Recipient: addr,
 			}},
 			IsReward: true,
+			Height: height,
 			Hash: []byte{},
 			Signature: []byte{},
 		}
-		tx.Sign(*sk)
 		tx.HashTx()
 		return tx
 	}
 	// Accummulate incomes
-	acc, acc_payments := acc_incomes(w.PK, a, bc)
-	if acc < a {
-		log.Panic(fmt.Sprintf("ERROR: %s cannot pay %d money: not enough money", string(w.Address), a))
+	total, _ := AddAmounts(a, fee) // checked by NewPayment
+	_, acc_payments := acc_incomes(pk, total, bc)
+	tx, err := NewPayment(w, acc_payments, r, a, fee, "")
+	if err != nil {
+		log.Panic(fmt.Sprintf("ERROR: %v", err))
+	}
+	return tx
+}
+
+// Make the tx of `w` that spends `incomes` (payments to `w`, chosen by the caller) to pay `a` to `r` and `fee` to the miner
+// The rest of the incomes is paid to `change` as change (back to `w` if `change` is empty, e.g. to a change wallet of an HD wallet)
+// Return an error if `r` or `change` is not valid, the amounts are illegal, or the incomes are not enough
+func NewPayment(w Signer, incomes []In, r utils.Address, a Amount, fee Amount, change utils.Address) (*Transaction, error) {
+	pk := w.PublicKey()
+	addr := utils.PKToAdress(pk)
+	if _, err := utils.ParseAddress(r.String()); err != nil {
+		return nil, fmt.Errorf("%s cannot pay to %s: %v", string(addr), r, err)
+	}
+	change_addr := addr
+	if change != "" {
+		if _, err := utils.ParseAddress(change.String()); err != nil {
+			return nil, fmt.Errorf("%s cannot pay change to %s: %v", string(addr), change, err)
+		}
+		change_addr = change.Bytes()
+	}
+	if a == 0 || a > MAX_MONEY {
+		return nil, fmt.Errorf("%s cannot pay %d money: illegal amount", string(addr), a)
+	}
+	total, ok := AddAmounts(a, fee)
+	if !ok {
+		return nil, fmt.Errorf("%s cannot pay %d money with %d fee: illegal amount", string(addr), a, fee)
+	}
+	acc := Amount(0)
+	for _, in := range incomes {
+		acc, ok = AddAmounts(acc, in.Amount)
+		if !ok {
+			return nil, fmt.Errorf("%s cannot spend incomes of more than MAX_MONEY", string(addr))
+		}
+	}
+	if acc < total {
+		return nil, fmt.Errorf("%s cannot pay %d money with %d fee: not enough money", string(addr), a, fee)
 	}
 	tx := &Transaction {
-		Initiator: w.PK,
-		Incomes: acc_payments,
+		Initiator: pk,
+		Incomes: incomes,
 		Payments: []Out{},
 		IsReward: false,
 		Hash: []byte{},
@@ -95,28 +141,31 @@ func NewTransaction(w *wallet.Wallet, r []byte, a int, is_reward bool, bc *Block
 	}
 	tx.Payments = append(tx.Payments, Out{
 		Amount: a,
-		Recipient: r,
+		Recipient: r.Bytes(),
 	})
-	if a < acc {
+	if total < acc {
 		tx.Payments = append(tx.Payments, Out{
-			Amount: acc - a,
-			Recipient: w.Address,
+			Amount: acc - total,
+			Recipient: change_addr,
 		})
 	}
+	sk, err := w.PrivateKey()
+	if err != nil {
+		return nil, err
+	}
 	tx.Sign(*sk)
 	tx.HashTx()
-	return tx
+	return tx, nil
 }
 
 func (tx *Transaction) HashTx() {
 	if len(tx.Hash) != 0 {
 		log.Panic("Tx already hashed")
 	}
-	if len(tx.Signature) == 0 {
+	if len(tx.Signature) == 0 && !tx.IsReward {
 		log.Panic("Tx haven't been signed")
 	}
-	hash := sha256.Sum256(tx.serialize())
-	tx.Hash = hash[:]
+	tx.Hash = tx.txid()
 }
 
 func (tx *Transaction) Sign(sk ecdsa.PrivateKey) {
@@ -126,15 +175,79 @@ func (tx *Transaction) Sign(sk ecdsa.PrivateKey) {
 	if len(tx.Hash) != 0 {
 		log.Panic("Tx hashed before signed")
 	}
-	r, s, err := ecdsa.Sign(rand.Reader, &sk, tx.serialize())
+	r, s, err := ecdsa.Sign(rand.Reader, &sk, tx.SigHash())
 	if err != nil {
 		log.Panic(err)
 	}
-	tx.Signature = append(r.Bytes(), s.Bytes()...)
+	tx.Signature = utils.EncodeSignature(r, s)
+}
+
+// The hash signed by the initiator: SHA256 of the sighash preimage (see encoding.go)
+func (tx *Transaction) SigHash() []byte {
+	hash := sha256.Sum256(tx.encode_sighash_preimage())
+	return hash[:]
 }
 
+// The id of the tx: SHA256 of the tx without its signature and hash (see encoding.go)
+func (tx *Transaction) txid() []byte {
+	hash := sha256.Sum256(tx.encode_unsigned())
+	return hash[:]
+}
+
+// The witness hash of the tx: SHA256 of the whole encoding of the tx, signature included (see encoding.go)
+// The leaves of the WitnessRoot of a block are witness hashes, so that the hash of a block also commits to the signatures
+func (tx *Transaction) WitnessHash() []byte {
+	hash := sha256.Sum256(tx.Encode())
+	return hash[:]
+}
+
+// Verify the tx against the branch ending at `prev_hash` (the tip if empty), as a tx of the next block of that branch
 func (tx *Transaction) Verify(bc *BlockChain, prev_hash []byte) bool {
-	return tx.verify_incomes(bc, prev_hash) && tx.verify_payments() && tx.verify_hash() && tx.verify_signature()
+	height := bc.Height() + 1
+	if len(prev_hash) != 0 {
+		prev := bc.GetBlock(prev_hash)
+		if prev == nil {
+			fmt.Printf("Verify: prevhash %x doesn't exist\n", prev_hash)
+			return false
+		}
+		height = prev.Height + 1
+	}
+	_, ok := tx.verify(bc.utxo_view(prev_hash), height, bc.Params)
+	return ok
+}
+
+// Verify the tx against `view`, as a tx of a block at `height`
+// return the fee of the tx (for a reward: the amount it claims, which is checked by the block)
+func (tx *Transaction) verify(view utxo_view, height int, params *ChainParams) (Amount, bool) {
+	in_amount, ok := tx.verify_incomes(view, height, params)
+	if !ok {
+		return 0, false
+	}
+	out_amount, ok := tx.verify_payments(in_amount)
+	if !ok || !tx.verify_hash() || !tx.verify_signature() {
+		return 0, false
+	}
+	if tx.IsReward {
+		return out_amount, true
+	}
+	return in_amount - out_amount, true
+}
+
+// The fee of a tx: the incomes that are not paid to any recipient, which goes to the miner of the block
+// Only meaningful for a verified non-reward tx, whose income amounts match the payments they refer to
+func (tx *Transaction) Fee() Amount {
+	in_amount := Amount(0)
+	for _, in := range tx.Incomes {
+		in_amount, _ = AddAmounts(in_amount, in.Amount)
+	}
+	out_amount := Amount(0)
+	for _, out := range tx.Payments {
+		out_amount, _ = AddAmounts(out_amount, out.Amount)
+	}
+	if out_amount > in_amount {
+		return 0
+	}
+	return in_amount - out_amount
 }
 
 func (tx *Transaction) PrintTx() string {
@@ -144,6 +257,7 @@ func (tx *Transaction) PrintTx() string {
 	string_tx = append(string_tx, fmt.Sprintf("\t\tSignature: %x", tx.Signature))
 	if tx.IsReward {
 		string_tx = append(string_tx, fmt.Sprintf("\t\tIsReward: True"))
+		string_tx = append(string_tx, fmt.Sprintf("\t\tHeight: %d", tx.Height))
 	} else {
 		string_tx = append(string_tx, fmt.Sprintf("\t\tIsReward: False"))
 		for iid, in := range tx.Incomes {
@@ -162,99 +276,100 @@ func (tx *Transaction) PrintTx() string {
 }
 
 
-// Accumulate `a` incomes for initiator `i` (pk) 
+// Accumulate `a` incomes for initiator `i` (pk) from the utxo set
 // return accumulations
 // return a set of incomes
-func acc_incomes(i []byte, a int, bc *BlockChain) (int, []In) {
-	acc := 0
-	acc_payments := []In{}
-	used_payments := make(map[string][]int)
-	initiator_addr := utils.PKToAdress(i)
-	iter := NewBlockChainIterator(bc)
-	for {
-		cur_block := iter.Next()
-		for _, tx := range cur_block.Txs {
-			key := hex.EncodeToString(tx.Hash)
-			tx_used_payments, _ := used_payments[key]
-			for oid, out := range tx.Payments {
-				if bytes.Compare(out.Recipient, initiator_addr) == 0 {
-					used := false
-					if tx_used_payments != nil {
-						for _, id := range tx_used_payments {
-							if id == oid {
-								used = true
-								break
-							}
-						}
-					}
-					if used == false {
-						acc += out.Amount
-						acc_payments = append(acc_payments, In{
-							HashTx: tx.Hash,
-							Idx: oid,
-							Amount: out.Amount,
-						})
-						if acc >= a {
-							return acc, acc_payments
-						}
-					}
-				}
-				
-			}
-
-			if bytes.Compare(tx.Initiator, i) == 0 && !tx.IsReward {
-				for _, in := range tx.Incomes {
-					paid_tx_key := hex.EncodeToString(in.HashTx)
-					used_payments[paid_tx_key] = append(used_payments[paid_tx_key], in.Idx)
-				}
-			}
-		}
-		if cur_block.IsGenisis {
-			break
-		}
-	}
-	return acc, acc_payments
+func acc_incomes(i []byte, a Amount, bc *BlockChain) (Amount, []In) {
+	return UTXOSet{bc}.FindSpendable(utils.HashPublicKey(i), a)
 }
 
-func (tx *Transaction) verify_incomes(bc *BlockChain, prev_hash []byte) bool {
-	if tx.IsReward {
-		return true
-	}
+// Whether all incomes of the tx are unspent in `view`
+func (tx *Transaction) spendable(view utxo_view) bool {
 	for _, in := range tx.Incomes {
-		if is_existed(in.HashTx, in.Idx, bc, prev_hash) == false || is_used(in.HashTx, in.Idx, bc, prev_hash) == true {
+		if _, ok := view.find(in.HashTx, in.Idx); !ok {
 			return false
 		}
 	}
 	return true
 }
 
-func (tx *Transaction) verify_payments() bool {
-	in_amount := 0
+// Check that every income of the tx:
+// - Appears once in the tx
+// - Refers to an unspent payment
+// - Refers to a mature payment, if it is paid by a reward tx (spent by a block at `height`)
+// - Refers to a payment to the initiator
+// - Has the amount of the payment it refers to
+// return the sum of the amounts of the referred payments
+func (tx *Transaction) verify_incomes(view utxo_view, height int, params *ChainParams) (Amount, bool) {
 	if tx.IsReward {
-		in_amount = REWARD
-	} else {
-		for _, in := range tx.Incomes {
-			in_amount += in.Amount
+		if len(tx.Incomes) != 0 {
+			fmt.Printf("verify_incomes: reward tx has incomes\n")
+			return 0, false
 		}
+		return MAX_MONEY, true // the amount of a reward is checked by its block
 	}
-	out_amount := 0
-	for _, out := range tx.Payments {
-		out_amount += out.Amount
+	in_amount := Amount(0)
+	initiator_addr := utils.PKToAdress(tx.Initiator)
+	used := make(map[string]bool)
+	for iid, in := range tx.Incomes {
+		key := Outpoint(in.HashTx, in.Idx)
+		if used[key] {
+			fmt.Printf("verify_incomes: income %d spends the %d-th payment of tx %x twice\n", iid, in.Idx, in.HashTx)
+			return 0, false
+		}
+		used[key] = true
+		unspent, ok := view.find(in.HashTx, in.Idx)
+		if !ok {
+			fmt.Printf("verify_incomes: the %d-th payment of tx %x doesn't exist or has been used\n", in.Idx, in.HashTx)
+			return 0, false
+		}
+		if !params.Mature(unspent, height) {
+			fmt.Printf("verify_incomes: the %d-th payment of tx %x is a reward at height %d, not mature at height %d\n", in.Idx, in.HashTx, unspent.Height, height)
+			return 0, false
+		}
+		out := unspent.Out
+		if bytes.Compare(out.Recipient, initiator_addr) != 0 {
+			fmt.Printf("verify_incomes: the %d-th payment of tx %x doesn't belong to the initiator\n", in.Idx, in.HashTx)
+			return 0, false
+		}
+		if in.Amount != out.Amount {
+			fmt.Printf("verify_incomes: income %d claims %d, but the %d-th payment of tx %x is %d\n", iid, in.Amount, in.Idx, in.HashTx, out.Amount)
+			return 0, false
+		}
+		in_amount, ok = AddAmounts(in_amount, out.Amount)
+		if !ok {
+			fmt.Printf("verify_incomes: sum of incomes exceeds MAX_MONEY\n")
+			return 0, false
+		}
+	}
+	return in_amount, true
+}
+
+// `in_amount`: the sum of the referred payments
+// return the sum of the payments
+func (tx *Transaction) verify_payments(in_amount Amount) (Amount, bool) {
+	out_amount := Amount(0)
+	for oid, out := range tx.Payments {
+		if out.Amount == 0 {
+			fmt.Printf("verify_payments: payment %d is zero\n", oid)
+			return 0, false
+		}
+		var ok bool
+		out_amount, ok = AddAmounts(out_amount, out.Amount)
+		if !ok {
+			fmt.Printf("verify_payments: sum of payments exceeds MAX_MONEY\n")
+			return 0, false
+		}
 	}
 	if out_amount > in_amount {
 		fmt.Printf("verify_payments: out_amount > in_amount\n")
-		return false
+		return 0, false
 	}
-	return true
+	return out_amount, true
 }
 
 func (tx *Transaction) verify_hash() bool {
-	tmp_tx := *tx
-	tmp_tx.Hash = []byte{}
-	//tmp_tx.Signature = []byte{}
-	//fmt.Printf("verify the hash of tx %s\n", tmp_tx.PrintTx())///////////////////////////////////////////////////////////
-	hash := sha256.Sum256(tmp_tx.serialize())
-	if bytes.Compare(hash[:], tx.Hash) != 0 {
+	if bytes.Compare(tx.txid(), tx.Hash) != 0 {
 		fmt.Printf("verify_hash: wrong tx hash\n")
 		return false
 	}
@@ -263,110 +378,32 @@ func (tx *Transaction) verify_hash() bool {
 
 func (tx *Transaction) verify_signature() bool {
 	if tx.IsReward {
+		if len(tx.Signature) != 0 {
+			fmt.Printf("verify_signature: reward tx has a signature\n")
+			return false
+		}
 		return true
 	}
-	tmp_tx := *tx
-	tmp_tx.Signature = []byte{}
-	tmp_tx.Hash = []byte{}
-	
-	r := big.Int{}
-	s := big.Int{}
-	sig_len := len(tx.Signature)
-	r.SetBytes(tx.Signature[:sig_len/2])
-	s.SetBytes(tx.Signature[sig_len/2:])
-
-	raw_pk := utils.RawPK(tx.Initiator)
-
-	if !ecdsa.Verify(&raw_pk, tmp_tx.serialize(), &r, &s) {
-		fmt.Printf("verify_signature: wrong tx signature\n")
+	r, s, ok := utils.DecodeSignature(tx.Signature)
+	if !ok {
+		fmt.Printf("verify_signature: signature is not %d bytes of low-S (r, s)\n", utils.SIG_LEN)
 		return false
 	}
-	return true
-}
-
-// Check whether the `oid`-th payment of `hash_tx` tx exists
-func is_existed(hash_tx []byte, oid int, bc *BlockChain, prev_hash []byte) bool {
-	iter := NewBlockChainIterator(bc)
-	start := false
-	if len(prev_hash) == 0 {
-		start = true
-	}
-	for {
-		cur_block := iter.Next()
-		if bytes.Compare(cur_block.Hash, prev_hash) == 0 {
-			start = true
-		}
-		if start == true {
-			tx := cur_block.find_tx(hash_tx)
-			if tx != nil {
-				return tx.has_payment(oid)
-			}
-			if cur_block.IsGenisis {
-				break
-			}
-		}
-	}
-	fmt.Printf("is_existed: the tx doesn't exist\n")
-	return false;
-}
 
-// Check whether the `oid`-th payment of `hash_tx` tx exists and has been used
-func is_used(hash_tx []byte, oid int, bc *BlockChain, prev_hash []byte) bool {
-	iter := NewBlockChainIterator(bc)
-	start := false
-	if len(prev_hash) == 0 {
-		start = true
-	}
-	for {
-		cur_block := iter.Next()
-		if bytes.Compare(cur_block.Hash, prev_hash) == 0 {
-			start = true
-		}
-		if start == true {
-			for _, tx := range cur_block.Txs {
-				if !tx.IsReward {
-					for in_id, in := range tx.Incomes {
-						if bytes.Compare(in.HashTx, hash_tx) == 0 && in.Idx == oid {
-							fmt.Printf("is_used: the %d-th payment of the tx has been used\n", in_id)
-							return true
-						}
-					}
-				}
-			}
-			if cur_block.IsGenisis {
-				break
-			}
-		}
-		
+	pk, err := utils.DecodePublicKey(tx.Initiator)
+	if err != nil {
+		fmt.Printf("verify_signature: %v\n", err)
+		return false
 	}
-	return false
-}
 
-func (tx *Transaction) has_payment(oid int) bool {
-	if oid < 0 || oid >= len(tx.Payments) {
-		fmt.Printf("has_payment: the payment doesn't exist\n")
+	if !ecdsa.Verify(pk, tx.SigHash(), r, s) {
+		fmt.Printf("verify_signature: wrong tx signature\n")
 		return false
 	}
 	return true
 }
 
-
+// The canonical encoding of the tx, see encoding.go
 func (tx *Transaction) serialize() []byte {
-	var data bytes.Buffer
-	encoder := gob.NewEncoder(&data)
-	err := encoder.Encode(*tx)
-	if err != nil {
-		log.Panic(err)
-	}
-	return data.Bytes()
+	return tx.Encode()
 }
-
-func deserialize(data []byte) *Transaction {
-	var tx Transaction
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&tx)
-	if err != nil {
-		log.Panic(err)
-	}
-	return &tx
-}
\ No newline at end of file
@@ -0,0 +1,568 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"Project2/utils"
+)
+
+// A UTXOSet stores:
+// - The blockchain whose "utxo" index it reads
+// The "utxo" index maps the hash of a tx to its payments that are unspent on the main chain
+// (the branch ending at the tip). It is updated by AppendBlock in the same store tx that moves the tip.
+// The "undo" index maps the hash of a block on the main chain to the payments it spent, so that
+// the block can be disconnected again when the tip switches to another branch.
+// A UTXOSet can:
+// - Find enough unspent payments of a pk hash to pay some amount
+// - Compute the balance of an address, and list its unspent payments
+// - Reindex: rebuild the "utxo" index by connecting the main chain from the genisis to the tip
+// - Audit the total supply: the unspent payments can never exceed the subsidies issued so far
+// Each unspent payment remembers the height of its block and whether it is paid by a reward tx,
+// since a reward can only be spent once it is mature (see ChainParams.Mature).
+
+const UTXO_INDEX = "utxo"
+const UNDO_INDEX = "undo"
+
+type UTXOSet struct {
+	BC *BlockChain
+}
+
+// The unspent payments of a tx. map: index of the payment -> payment
+// `Height`: the height of the block of the tx
+// `IsReward`: whether the tx is a reward
+type UnspentOuts struct {
+	Outs     map[int]Out
+	Height   int
+	IsReward bool
+}
+
+// An unspent payment, with the height of its block and whether it is paid by a reward tx
+type UnspentOut struct {
+	Out      Out
+	Height   int
+	IsReward bool
+}
+
+// A payment spent by a block, kept to disconnect the block
+type SpentOut struct {
+	HashTx  []byte
+	Idx     int
+	Unspent UnspentOut
+}
+
+// A utxo_view answers whether the `idx`-th payment of the `hash_tx` tx is unspent at some point of the chain
+type utxo_view interface {
+	find(hash_tx []byte, idx int) (UnspentOut, bool)
+}
+
+// A utxo_store is a utxo_view that blocks can be connected to and disconnected from
+type utxo_store interface {
+	utxo_view
+	add(hash_tx []byte, idx int, unspent UnspentOut)
+	spend(hash_tx []byte, idx int)
+}
+
+// Accumulate unspent payments to `pk_hash` until they reach `amount`
+// Rewards that are not mature for the block on top of the tip are skipped
+// return accumulations
+// return a set of incomes
+func (u UTXOSet) FindSpendable(pk_hash []byte, amount Amount) (Amount, []In) {
+	acc := Amount(0)
+	acc_payments := []In{}
+	addr := utils.HashPKToAddress(pk_hash)
+	err := u.BC.Store.View(func(tx StoreTx) error {
+		height := 0 // of the block that will include the incomes
+		if tip := tx.Tip(); tip != nil {
+			height = get_block(tx, tip).Height + 1
+		}
+		return tx.ForEach(UTXO_INDEX, func(k, v []byte) error {
+			outs := deserialize_outs(v)
+			for idx, out := range outs.Outs {
+				if acc >= amount {
+					return nil
+				}
+				if bytes.Compare(out.Recipient, addr) != 0 || !u.BC.Params.Mature(outs.unspent(out), height) {
+					continue
+				}
+				sum, ok := AddAmounts(acc, out.Amount)
+				if !ok {
+					continue
+				}
+				acc = sum
+				acc_payments = append(acc_payments, In{
+					HashTx: k,
+					Idx:    idx,
+					Amount: out.Amount,
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return acc, acc_payments
+}
+
+// Sum all unspent payments to `addr`
+func (u UTXOSet) Balance(addr []byte) Amount {
+	balance := Amount(0)
+	err := u.BC.Store.View(func(tx StoreTx) error {
+		return tx.ForEach(UTXO_INDEX, func(k, v []byte) error {
+			for _, out := range deserialize_outs(v).Outs {
+				if bytes.Compare(out.Recipient, addr) == 0 {
+					balance = CapAmounts(balance, out.Amount)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return balance
+}
+
+// The txs of `txs` (not in the blockchain yet, e.g. a mempool) whose incomes are all still there: unspent on the main chain,
+// or paid by another tx left (not a reward, which can only be spent in a block)
+// A tx with an income that is gone is in a block, conflicts with a tx in a block, or spends the payments of such a tx
+// Keep the order of `txs`
+func (u UTXOSet) LiveTxs(txs []*Transaction) []*Transaction {
+	live := make(map[string]*Transaction)
+	for _, tx := range txs {
+		live[hex.EncodeToString(tx.Hash)] = tx
+	}
+	for removed := true; removed; {
+		removed = false
+		for key, tx := range live {
+			for _, in := range tx.Incomes {
+				parent, ok := live[hex.EncodeToString(in.HashTx)]
+				if ok && !parent.IsReward && in.Idx < len(parent.Payments) {
+					continue
+				}
+				if _, ok := u.find(in.HashTx, in.Idx); ok {
+					continue
+				}
+				delete(live, key)
+				removed = true
+				break
+			}
+		}
+	}
+	var res []*Transaction
+	for _, tx := range txs {
+		if _, ok := live[hex.EncodeToString(tx.Hash)]; ok {
+			res = append(res, tx)
+		}
+	}
+	return res
+}
+
+// The `idx`-th payment of the `hash_tx` tx, if it is unspent on the main chain
+func (u UTXOSet) Find(hash_tx []byte, idx int) (UnspentOut, bool) {
+	return u.find(hash_tx, idx)
+}
+
+// An unspent payment of the "utxo" index: the `Idx`-th payment of the tx `HashTx`
+type UTXO struct {
+	HashTx  []byte
+	Idx     int
+	Unspent UnspentOut
+}
+
+// List all unspent payments to `addr`
+// return the payments
+// return the height of the tip they are unspent at (-1 if the chain is empty)
+func (u UTXOSet) ListUnspent(addr []byte) ([]UTXO, int) {
+	var utxos []UTXO
+	height := -1
+	err := u.BC.Store.View(func(tx StoreTx) error {
+		if tip := tx.Tip(); tip != nil {
+			height = get_block(tx, tip).Height
+		}
+		return tx.ForEach(UTXO_INDEX, func(k, v []byte) error {
+			outs := deserialize_outs(v)
+			for idx, out := range outs.Outs {
+				if bytes.Compare(out.Recipient, addr) == 0 {
+					utxos = append(utxos, UTXO{
+						HashTx:  append([]byte{}, k...),
+						Idx:     idx,
+						Unspent: outs.unspent(out),
+					})
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return utxos, height
+}
+
+func (u UTXOSet) Reindex() {
+	err := u.BC.Store.Update(func(tx StoreTx) error {
+		reindex_utxo(tx)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// A SupplyAudit stores:
+// - Height: the height of the main chain audited
+// - Unspent: the sum of the unspent payments at that height (MAX_MONEY if it exceeds MAX_MONEY)
+// - Overflow: whether the sum of the unspent payments exceeds MAX_MONEY
+// - Issued: the sum of the subsidies of the blocks up to that height
+// Unspent can be less than Issued (fees or subsidies that are not claimed are lost), but never more
+type SupplyAudit struct {
+	Height   int
+	Unspent  Amount
+	Overflow bool
+	Issued   Amount
+}
+
+func (a *SupplyAudit) Inflated() bool {
+	return a.Overflow || a.Unspent > a.Issued
+}
+
+func (a *SupplyAudit) add_unspent(amount Amount) {
+	sum, ok := AddAmounts(a.Unspent, amount)
+	if !ok {
+		a.Overflow = true
+		sum = MAX_MONEY
+	}
+	a.Unspent = sum
+}
+
+// Audit the total supply of the main chain at `height` (the tip if `height` is beyond it)
+// At the tip the "utxo" index itself is summed; below the tip the main chain is replayed in memory
+func (bc *BlockChain) TotalSupply(height int) *SupplyAudit {
+	audit := &SupplyAudit{}
+	err := bc.Store.View(func(tx StoreTx) error {
+		tip := tx.Tip()
+		if tip == nil {
+			audit.Height = -1
+			return nil
+		}
+		tip_block := get_block(tx, tip)
+		if height >= tip_block.Height {
+			audit.Height = tip_block.Height
+			return tx.ForEach(UTXO_INDEX, func(k, v []byte) error {
+				for _, out := range deserialize_outs(v).Outs {
+					audit.add_unspent(out.Amount)
+				}
+				return nil
+			})
+		}
+		audit.Height = height
+		var main_chain []*Block // from `height` to the genisis
+		for cur_block := tip_block; ; cur_block = get_block(tx, cur_block.PrevHash) {
+			if cur_block.Height <= height {
+				main_chain = append(main_chain, cur_block)
+			}
+			if cur_block.IsGenisis {
+				break
+			}
+		}
+		view := new_overlay_view(empty_view{})
+		for i := len(main_chain) - 1; i >= 0; i-- {
+			connect_block(view, main_chain[i])
+		}
+		for _, unspent := range view.added {
+			audit.add_unspent(unspent.Out.Amount)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	audit.Issued = bc.Params.Issuance(audit.Height)
+	if audit.Inflated() {
+		fmt.Printf("TotalSupply: %d unspent (overflow %v) at height %d, but only %d issued\n", audit.Unspent, audit.Overflow, audit.Height, audit.Issued)
+	}
+	return audit
+}
+
+func (u UTXOSet) find(hash_tx []byte, idx int) (UnspentOut, bool) {
+	var unspent UnspentOut
+	found := false
+	err := u.BC.Store.View(func(tx StoreTx) error {
+		unspent, found = index_store{tx}.find(hash_tx, idx)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return unspent, found
+}
+
+// Rebuild the "utxo" index from the main chain, inside the caller's store tx
+func reindex_utxo(tx StoreTx) {
+	tx.Clear(UTXO_INDEX)
+	var main_chain []*Block // from the tip to the genisis
+	hash := tx.Tip()
+	for len(hash) != 0 {
+		cur_block := get_block(tx, hash)
+		main_chain = append(main_chain, cur_block)
+		if cur_block.IsGenisis {
+			break
+		}
+		hash = cur_block.PrevHash
+	}
+	for i := len(main_chain) - 1; i >= 0; i-- {
+		connect_utxo(tx, main_chain[i])
+	}
+}
+
+// Connect a block that extends the main chain to the "utxo" index and record its undo data, inside the caller's store tx
+func connect_utxo(tx StoreTx, b *Block) {
+	undo := connect_block(index_store{tx}, b)
+	var data bytes.Buffer
+	encoder := gob.NewEncoder(&data)
+	err := encoder.Encode(undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx.Put(UNDO_INDEX, b.Hash, data.Bytes())
+}
+
+// Disconnect the tip block of the main chain from the "utxo" index, inside the caller's store tx
+func disconnect_utxo(tx StoreTx, b *Block) {
+	disconnect_block(index_store{tx}, b, get_undo(tx, b.Hash))
+}
+
+func get_undo(tx StoreTx, hash []byte) []SpentOut {
+	data := tx.Get(UNDO_INDEX, hash)
+	if data == nil {
+		log.Panic(fmt.Sprintf("get_undo: no undo data for block %x", hash))
+	}
+	var undo []SpentOut
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return undo
+}
+
+// Spend the incomes and add the payments of the txs of `b`
+// The txs are connected in order, so a tx can spend the payments of an earlier tx of `b`
+// return the spent payments
+func connect_block(store utxo_store, b *Block) []SpentOut {
+	undo := []SpentOut{}
+	for _, cur_tx := range b.Txs {
+		undo = append(undo, apply_tx(store, cur_tx, b.Height)...)
+	}
+	return undo
+}
+
+// Spend the incomes and add the payments of `tx`, in a block at `height`
+// return the spent payments
+func apply_tx(store utxo_store, tx *Transaction, height int) []SpentOut {
+	undo := []SpentOut{}
+	if !tx.IsReward {
+		for _, in := range tx.Incomes {
+			unspent, ok := store.find(in.HashTx, in.Idx)
+			if !ok {
+				fmt.Printf("connect_block: tx %x spends a payment that is not in the utxo set\n", tx.Hash)
+				continue
+			}
+			undo = append(undo, SpentOut{
+				HashTx:  in.HashTx,
+				Idx:     in.Idx,
+				Unspent: unspent,
+			})
+			store.spend(in.HashTx, in.Idx)
+		}
+	}
+	for idx, out := range tx.Payments {
+		store.add(tx.Hash, idx, UnspentOut{
+			Out:      out,
+			Height:   height,
+			IsReward: tx.IsReward,
+		})
+	}
+	return undo
+}
+
+// Undo connect_block: remove the payments of the txs of `b` and give back the payments it spent
+// (except the payments of its own txs, which are gone with the block)
+func disconnect_block(store utxo_store, b *Block, undo []SpentOut) {
+	in_block := make(map[string]bool)
+	for i := len(b.Txs) - 1; i >= 0; i-- {
+		for idx := range b.Txs[i].Payments {
+			store.spend(b.Txs[i].Hash, idx)
+		}
+		in_block[hex.EncodeToString(b.Txs[i].Hash)] = true
+	}
+	for _, spent := range undo {
+		if in_block[hex.EncodeToString(spent.HashTx)] {
+			continue
+		}
+		store.add(spent.HashTx, spent.Idx, spent.Unspent)
+	}
+}
+
+// The unspent payments of the branch ending at `prev_hash`.
+// The "utxo" index is used directly when `prev_hash` is the tip (or empty);
+// otherwise the main chain is disconnected back to the fork point and the branch connected, in memory.
+func (bc *BlockChain) utxo_view(prev_hash []byte) utxo_view {
+	var view *overlay_view
+	err := bc.Store.View(func(tx StoreTx) error {
+		tip := tx.Tip()
+		if len(prev_hash) == 0 || bytes.Compare(tip, prev_hash) == 0 {
+			return nil
+		}
+		view = new_overlay_view(index_store{tx})
+		main_side, branch_side := find_fork(tx, tip, prev_hash)
+		for _, cur_block := range main_side {
+			disconnect_block(view, cur_block, get_undo(tx, cur_block.Hash))
+		}
+		for i := len(branch_side) - 1; i >= 0; i-- {
+			connect_block(view, branch_side[i])
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if view == nil {
+		return UTXOSet{bc}
+	}
+	view.base = UTXOSet{bc} // the store tx above is closed
+	return view
+}
+
+// The "utxo" index as a utxo_store
+type index_store struct {
+	tx StoreTx
+}
+
+func (s index_store) find(hash_tx []byte, idx int) (UnspentOut, bool) {
+	data := s.tx.Get(UTXO_INDEX, hash_tx)
+	if data == nil {
+		return UnspentOut{}, false
+	}
+	outs := deserialize_outs(data)
+	out, ok := outs.Outs[idx]
+	if !ok {
+		return UnspentOut{}, false
+	}
+	return outs.unspent(out), true
+}
+
+func (s index_store) add(hash_tx []byte, idx int, unspent UnspentOut) {
+	outs := &UnspentOuts{
+		Outs: make(map[int]Out),
+	}
+	if data := s.tx.Get(UTXO_INDEX, hash_tx); data != nil {
+		outs = deserialize_outs(data)
+		if outs.Outs == nil {
+			outs.Outs = make(map[int]Out)
+		}
+	}
+	outs.Outs[idx] = unspent.Out
+	outs.Height = unspent.Height
+	outs.IsReward = unspent.IsReward
+	s.tx.Put(UTXO_INDEX, hash_tx, outs.serialize())
+}
+
+func (s index_store) spend(hash_tx []byte, idx int) {
+	data := s.tx.Get(UTXO_INDEX, hash_tx)
+	if data == nil {
+		return
+	}
+	outs := deserialize_outs(data)
+	delete(outs.Outs, idx)
+	if len(outs.Outs) == 0 {
+		s.tx.Delete(UTXO_INDEX, hash_tx)
+	} else {
+		s.tx.Put(UTXO_INDEX, hash_tx, outs.serialize())
+	}
+}
+
+// A view where nothing is unspent
+type empty_view struct{}
+
+func (empty_view) find(hash_tx []byte, idx int) (UnspentOut, bool) {
+	return UnspentOut{}, false
+}
+
+// An in-memory utxo_store on top of another view, which is never written
+type overlay_view struct {
+	base  utxo_view
+	added map[string]UnspentOut // map: outpoint -> payment added on top of `base`
+	spent map[string]bool       // map: outpoint -> whether the payment is spent on top of `base`
+}
+
+func new_overlay_view(base utxo_view) *overlay_view {
+	return &overlay_view{
+		base:  base,
+		added: make(map[string]UnspentOut),
+		spent: make(map[string]bool),
+	}
+}
+
+func (v *overlay_view) find(hash_tx []byte, idx int) (UnspentOut, bool) {
+	key := Outpoint(hash_tx, idx)
+	if v.spent[key] {
+		return UnspentOut{}, false
+	}
+	if unspent, ok := v.added[key]; ok {
+		return unspent, true
+	}
+	return v.base.find(hash_tx, idx)
+}
+
+func (v *overlay_view) add(hash_tx []byte, idx int, unspent UnspentOut) {
+	key := Outpoint(hash_tx, idx)
+	delete(v.spent, key)
+	v.added[key] = unspent
+}
+
+func (v *overlay_view) spend(hash_tx []byte, idx int) {
+	key := Outpoint(hash_tx, idx)
+	delete(v.added, key)
+	v.spent[key] = true
+}
+
+// The key of the `idx`-th payment of the `hash_tx` tx
+// The key of the `idx`-th payment of the tx `hash_tx`, e.g. in a set of payments
+func Outpoint(hash_tx []byte, idx int) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(hash_tx), idx)
+}
+
+// `out` as an unspent payment of the tx of `outs`
+func (outs *UnspentOuts) unspent(out Out) UnspentOut {
+	return UnspentOut{
+		Out:      out,
+		Height:   outs.Height,
+		IsReward: outs.IsReward,
+	}
+}
+
+func (outs *UnspentOuts) serialize() []byte {
+	var data bytes.Buffer
+	encoder := gob.NewEncoder(&data)
+	err := encoder.Encode(*outs)
+	if err != nil {
+		log.Panic(err)
+	}
+	return data.Bytes()
+}
+
+func deserialize_outs(data []byte) *UnspentOuts {
+	var outs UnspentOuts
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&outs)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &outs
+}
@@ -1,61 +1,131 @@
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"time"
 	"os"
 	"log"
+	"path/filepath"
 
+	"Project2/blockchain"
 	"Project2/miner"
+	"Project2/utils"
+	"Project2/wallet"
 )
 
-// 1. New Miner
+// 1. New Miner (open the blockchain of the `chain` preset in `datadir`, resuming from its tip if it already exists)
 // 2. Start service
-// 3. Create Wallet
-// 4. Prime miner create and broadcast the genisis
-// 5. Prime miner uniformly distribute all money to all wallets
+// 3. Create Wallet (or load the wallets created before a restart)
+//    Wallets are encrypted in the keystore `keystore` with the passphrase in $WALLET_PASSPHRASE, and derived from its seed
+//    With `seed`, the wallets of the seed that are used on the blockchain are restored
+//    The seed is backed up and restored as words by `main wallet create|backup|restore` (see wallet_command)
+// 4. Build the genisis from the `genesis` config file, which pays the initial money to the allocated addresses (unless the blockchain is resumed)
+//    Without a config file, prime miner create and broadcast the genisis (unless the blockchain is resumed)
+// 5. Without a config file, prime miner uniformly distribute all money to all wallets (unless the blockchain is resumed)
 // 6. Begin client
+// The money distributed to each wallet and the number of txs per client are in the params of the chain (see blockchain/chain_params.go)
 
 const PRIME = "8060"
 const PREPARE_TIME = 10
 const RESULT_TIME = 10
-const PREPARE_MONEY = 20 // since REWARD = 100 (in transaction.go) and there are 5 wallets (1 for each miner), each miner initially gets 20
-const TXS = 20 // `TXS` txs per client 
 var (
 	machine_id = flag.String("mid", "8060", "machine id (string)")
+	data_dir = flag.String("datadir", "/osdata/osgroup10", "directory of the blockchain db")
+	chain = flag.String("chain", "experiment", "params of the chain: mainnet, regtest or experiment")
+	keystore_dir = flag.String("keystore", "", "directory of the encrypted wallets (default: <datadir>/keystore-<mid>)")
+	seed_hex = flag.String("seed", "", "restore the wallets of this seed (hex) into a keystore without a seed")
+	genesis_file = flag.String("genesis", "", "genisis config file (JSON); if empty, the prime miner mines the genisis and distributes the money")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "wallet" {
+		wallet_command(os.Args[2:])
+		return
+	}
 	flag.Parse()
 	//fmt.Printf("Machine %s\n", *machine_id)///////////////////////////////////////////////////
-	m := miner.NewMiner(*machine_id)
+	params, err := blockchain.ParamsByName(*chain)
+	if err != nil {
+		log.Fatal("Fail to select the chain, ", err)
+	}
+	opts := &blockchain.Options{
+		Params: params,
+	}
+	var genesis *blockchain.Block
+	if *genesis_file != "" {
+		cfg, err := blockchain.LoadGenesisConfig(*genesis_file)
+		if err != nil {
+			log.Fatal("Fail to load the genisis, ", err)
+		}
+		genesis, err = blockchain.NewGenesisBlock(cfg, params)
+		if err != nil {
+			log.Fatal("Fail to build the genisis, ", err)
+		}
+		opts.GenesisHash = genesis.Hash // no other genisis is accepted
+	} else if len(params.GenesisHash) != 0 {
+		log.Fatalf("Chain %s pins genisis %x, give its config with -genesis (e.g. genesis/%s.json)", params.Name, params.GenesisHash, params.Name)
+	}
+	bc, err := blockchain.OpenBlockChain(filepath.Join(*data_dir, "blockchain-" + *machine_id + ".db"), opts)
+	if err != nil {
+		log.Fatal("Fail to open the blockchain, ", err)
+	}
+	ks, pass := open_keystore()
+	if *seed_hex != "" {
+		seed, err := hex.DecodeString(*seed_hex)
+		if err != nil {
+			log.Fatal("Invalid seed, ", err)
+		}
+		_, err = ks.StoreSeed(seed, pass)
+		if err != nil {
+			log.Fatal("Fail to restore the seed, ", err)
+		}
+	}
+	resumed := bc.Tip() != nil
+	if genesis != nil && !resumed {
+		fmt.Printf("Append genisis %x from %s\n", genesis.Hash, *genesis_file)
+		bc.AppendBlock(genesis)
+	}
+	bootstrap := genesis == nil && !resumed // the prime miner mines the genisis and distributes the money
+	m := miner.NewMiner(*machine_id, bc, ks, pass)
 	fmt.Printf("New miner %#v created\n", *m)//////////////////////////////////////
 	go m.StartService()
 	// Assume each machine has one wallet
 	// TODO: each machine has multiple wallets, and can create a wallet at any time
 	// Wait for the service to get started
 	time.Sleep(time.Duration(PREPARE_TIME) * time.Second)
-	m.CreateWallet()
+	if m.LoadWallets() == 0 {
+		m.CreateWallet()
+	}
 	// Wait for the addresses before creating genisis
 	time.Sleep(time.Duration(PREPARE_TIME) * time.Second)
 	fmt.Printf("%s\n", m.PrintMiner())/////////////////////////////////////////////////////
-	if m.MID == PRIME {
+	if m.MID == PRIME && bootstrap {
 		m.CreateGenisis()
 	}
 	// Wait for the genisis to reach all miners
 	time.Sleep(time.Duration(PREPARE_TIME) * time.Second)
-	if m.MID == PRIME {
+	if m.MID == PRIME && bootstrap {
 		for _, addrs := range m.Addrs {
-			m.CreateTx(m.Addrs[m.MID][0], addrs[0], PREPARE_MONEY)
+			err := m.CreateTx(addrs[0], params.PrepareMoney, 0)
+			if err != nil {
+				log.Fatal("Fail to distribute the money, ", err)
+			}
 		}
 	}
 	// Wait for the money to reach all miners
 	time.Sleep(2 * time.Duration(PREPARE_TIME) * time.Second)
-	m.StartClient(TXS)
+	m.StartClient(params.Txs)
 	// Wait for all miners to end their tasks
 	time.Sleep(time.Duration(RESULT_TIME) * time.Second)
 	fmt.Printf("Finishes. Print the blockchain.\n")/////////////////////////////
+	ledger := m.Ledger()
+	for _, addr := range m.Keystore.List() {
+		fmt.Printf("%s\n", ledger.PrintBalance(utils.Address(addr), 1))
+	}
 
 	bc_file, err := os.OpenFile("blockchain" + m.MID, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
 	if err != nil {
@@ -66,5 +136,74 @@ func main() {
 		log.Fatal("Fail to write the blockchain to file, ", err)
 	}
 	bc_file.Close()
-	
-}
\ No newline at end of file
+	bc.Close()
+
+}
+
+// Open the keystore of the flags, and read the passphrase of its wallets
+func open_keystore() (*wallet.Keystore, string) {
+	if *keystore_dir == "" {
+		*keystore_dir = filepath.Join(*data_dir, "keystore-" + *machine_id)
+	}
+	ks, err := wallet.NewKeystore(*keystore_dir, 0) // the wallets of the miner stay unlocked
+	if err != nil {
+		log.Fatal("Fail to open the keystore, ", err)
+	}
+	pass := os.Getenv("WALLET_PASSPHRASE")
+	if pass == "" {
+		fmt.Printf("WARNING: WALLET_PASSPHRASE is empty, the wallets are encrypted with an empty passphrase\n")
+	}
+	return ks, pass
+}
+
+// `main wallet <command> [flags]`: back up or restore the seed of a keystore as a mnemonic (see wallet/mnemonic.go)
+// - create: generate a seed in a keystore without one, and print its words
+// - backup: print the words of the seed
+// - restore: read the words from stdin and store their seed in a keystore without one
+//		(the miner finds the wallets of the seed on the blockchain when it starts)
+// The flags are those of the miner (-keystore, or -datadir and -mid)
+func wallet_command(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: wallet create|backup|restore [-keystore dir] [-datadir dir] [-mid id]")
+	}
+	flag.CommandLine.Parse(args[1:])
+	ks, pass := open_keystore()
+	var hd *wallet.HDWallet
+	var err error
+	switch args[0] {
+	case "create":
+		hd, err = ks.NewSeed(pass)
+	case "backup":
+		hd, err = ks.UnlockSeed(pass)
+	case "restore":
+		fmt.Printf("Enter the words of the seed:\n")
+		line, read_err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if read_err != nil && read_err != io.EOF {
+			log.Fatal("Fail to read the words, ", read_err)
+		}
+		var seed []byte
+		seed, err = wallet.DecodeMnemonic(line)
+		if err == nil {
+			hd, err = ks.StoreSeed(seed, pass)
+		}
+	default:
+		log.Fatal("Unknown wallet command ", args[0])
+	}
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Fail to %s the seed of keystore %s, ", args[0], ks.Dir), err)
+	}
+	words, err := wallet.EncodeMnemonic(hd.Seed)
+	if err != nil {
+		log.Fatal("Fail to encode the seed, ", err)
+	}
+	// The first receive address, to check a restored seed against the original one
+	first, err := hd.Wallet(wallet.RECEIVE_CHAIN, 0)
+	if err != nil {
+		log.Fatal("Fail to derive the first wallet, ", err)
+	}
+	if args[0] != "restore" {
+		fmt.Printf("Write down the words of the seed of keystore %s:\n%s\n", ks.Dir, words)
+	}
+	fmt.Printf("First address: %s\n", utils.PKToAdress(first.PK))
+}
+
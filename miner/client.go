@@ -1,6 +1,7 @@
 package miner
 
 import (
+	"bytes"
 	"net/rpc"
 	"log"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 
 	"Project2/blockchain"
+	"Project2/utils"
 	"Project2/wallet"
 )
 
@@ -17,6 +19,7 @@ import (
 // - Make and broadcast a tx (RPC client)
 
 const SLEEP = 10 // the time interval between sending two txs is 10s
+const FEE = 1 // the fee of each tx, paid to the miner that includes it
 
 // `n`: number of txs the client need to make
 func (m *Miner) StartClient(n int) {
@@ -26,52 +29,112 @@ func (m *Miner) StartClient(n int) {
 	}
 	time.Sleep(time.Duration(noise - 8060) * time.Second)
 	for i := 0; i < n; i++ {
-		dest_idx := rand.Intn(len(m.Addrs))
-		j := 0
+		// The machines whose addresses are known (a machine that restarted may not know the addresses of the others)
+		var known [][]string
 		for _, addrs := range m.Addrs {
-			if j == dest_idx {
-				addr := addrs[rand.Intn(len(addrs))] // randomly select a recipient
-				m.CreateTx(m.Addrs[m.MID][rand.Intn(len(m.Addrs[m.MID]))], addr, 1) // randomly select a wallet of `m` and pay 1 coin
-				time.Sleep(time.Duration(SLEEP) * time.Second)
-				break
+			if len(addrs) != 0 {
+				known = append(known, addrs)
 			}
-			j++
 		}
+		if len(known) == 0 {
+			fmt.Printf("Machine %s knows no address to pay\n", m.MID)
+			time.Sleep(time.Duration(SLEEP) * time.Second)
+			continue
+		}
+		addrs := known[rand.Intn(len(known))]
+		addr := addrs[rand.Intn(len(addrs))] // randomly select a recipient
+		err := m.CreateTx(addr, 1, FEE) // pay 1 coin
+		if err != nil {
+			fmt.Printf("Machine %s fails to create tx: %v\n", m.MID, err)
+		}
+		time.Sleep(time.Duration(SLEEP) * time.Second)
 	}
 	//fmt.Printf("Client process started\n")/////////////////////////////////////////////////////////////
 }
 
-// `from`: one of m's wallet address
-// `to`: the address of the receiver 
-func (m *Miner) CreateTx(from string, to string, amount int) {
+// Pay `amount` to `to` from the first wallet of `m` that has enough money that is not spent by its pending txs,
+// and the change to the change wallet of `m` (see change_wallet)
+// `to`: the address of the receiver, one of the known addresses
+// `fee`: the fee paid to the miner of the block
+// Return an error if `to` is not a known valid address, no wallet of `m` has enough money,
+// or the tx cannot be sent to some machine
+// A tx that no machine has received is dropped, and the payments it spends are unlocked. A tx that some machine has
+// received can still be mined, so it stays pending (until it expires or leaves the mempool of `m`)
+func (m *Miner) CreateTx(to string, amount blockchain.Amount, fee blockchain.Amount) error {
+	recipient, err := utils.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+	known := false
 	for _, addrs := range m.Addrs {
 		for _, addr := range addrs {
-			if addr == to {
-				// Select 
-				tx := blockchain.NewTransaction(wallet.ReadWallet(m.MID, from), []byte(to), amount, false, m.BC)
-				fmt.Printf("address%s %d -> address%s\n", from, amount, to)//////////////////////////////////////////////////////////
-				m.broadcast_tx(&MsgTx{
-					Tx: *tx,
-				})
-			}
+			known = known || addr == to
 		}
 	}
+	if !known {
+		return fmt.Errorf("unknown address %s", to)
+	}
+	change, err := m.change_wallet()
+	if err != nil {
+		return err
+	}
+	var change_addr utils.Address
+	if change != nil {
+		change_addr = utils.Address(change.Address)
+	}
+	var wallets []*wallet.Wallet
+	for _, addr := range m.Keystore.List() {
+		wallets = append(wallets, m.wallet(addr))
+	}
+	tx, err := m.Spender.PayFrom(wallets, recipient, amount, fee, change_addr)
+	if err != nil {
+		return err
+	}
+	for _, out := range tx.Payments {
+		if change != nil && bytes.Compare(out.Recipient, change.Address) == 0 {
+			m.change = nil // used, the next tx pays change to a new change wallet
+		}
+	}
+	fmt.Printf("address%s %d -> address%s\n", utils.PKToAdress(tx.Initiator), amount, to)//////////////////////////////////////////////////////////
+	acked, err := m.broadcast_tx(&MsgTx{
+		Tx: tx.Encode(),
+	})
+	if acked == 0 {
+		m.Spender.Drop(tx.Hash)
+	}
+	return err
 }
 
-func (m *Miner) broadcast_tx(msg *MsgTx) {
+// Send the tx to every machine
+// Return the number of machines that ACK, and an error if a machine cannot be reached or does not ACK
+func (m *Miner) broadcast_tx(msg *MsgTx) (int, error) {
+	acked := 0
+	var first_err error
 	for dest, _ := range m.Addrs {
-		c, err := rpc.Dial("tcp", IP[dest] + PORT)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("machine %s fails to dial %s", m.MID, IP[dest] + PORT), err)
-		}
-		var rep Rep 
-		fmt.Printf("Machine %s begins to broadcast tx msg %#v to machine %s\n", m.MID, *msg, dest)///////////////////////////////////
-		err = c.Call("Miner.HandleTx", *msg, &rep)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("machine %s fails to call %s", m.MID, IP[dest] + PORT), err)
-		}
-		if rep.R != "ACK" {
-			log.Fatal(fmt.Sprintf("machine %s fails get ACK reply", m.MID, IP[dest] + PORT))
+		err := m.send_tx(dest, msg)
+		if err == nil {
+			acked++
+		} else if first_err == nil {
+			first_err = err
 		}
 	}
+	return acked, first_err
+}
+
+func (m *Miner) send_tx(dest string, msg *MsgTx) error {
+	c, err := rpc.Dial("tcp", IP[dest] + m.Params.Port)
+	if err != nil {
+		return fmt.Errorf("machine %s fails to dial %s: %v", m.MID, IP[dest] + m.Params.Port, err)
+	}
+	defer c.Close()
+	var rep Rep 
+	fmt.Printf("Machine %s begins to broadcast tx msg (%d bytes) to machine %s\n", m.MID, len(msg.Tx), dest)///////////////////////////////////
+	err = c.Call("Miner.HandleTx", *msg, &rep)
+	if err != nil {
+		return fmt.Errorf("machine %s fails to call %s: %v", m.MID, IP[dest] + m.Params.Port, err)
+	}
+	if rep.R != "ACK" {
+		return fmt.Errorf("machine %s fails get ACK reply from %s", m.MID, IP[dest] + m.Params.Port)
+	}
+	return nil
 }
\ No newline at end of file
@@ -8,41 +8,53 @@ import (
 	"net"
 	"net/rpc"
 	"strings"
+	"time"
 
 	"Project2/blockchain"
+	"Project2/utils"
 	"Project2/wallet"
 )
 
 // A miner has:
-// - A set of addresses he has created (i.e., a set of wallets)
+// - A set of addresses he has created (i.e., a set of wallets), stored in a keystore and unlocked with the passphrase of the miner
 // - A blockchain
+// - The params of the chain (the Threshold of txs to mine a block, the Port of the RPC service, see blockchain/chain_params.go)
 // - An id: specify which machine the user is on
 // - A mempool to store unsolved txs
 // - All the addresses that the user knows. map: machine_id -> wallet addresses
+// - An orphan pool to store blocks that arrive before their previous block
 // A miner can:
 // - Create a wallet
-//		1. Create a new wallet (write to file, store in Addrs)
+//		1. Derive a new receive wallet from the seed (encrypt to the keystore, store in Addrs)
 //		2. Broadcast the new address
+// - Load the wallets it created before a restart (importing the legacy unencrypted wallet files first), and broadcast their addresses
+//		The wallets of its seed are found again on the blockchain, so a keystore with only the seed is restored
+// - Tell the balance, unspent payments and history of an address (see wallet/ledger.go)
+// - Make txs with a Spender (see wallet/spender.go), so that back-to-back txs of a wallet never spend the same payment
+//   A tx is paid by any wallet of the miner with enough money, and its change goes to a change wallet of the seed
 // - Broadcast an address (RPC client)
 // - Broadcast a block (RPC client)
 // - Receive an address (RPC server)
-//		1. Add the address to the user's KNOWNADDR list
+//		1. Add the address to the user's KNOWNADDR list (if it is a valid address that is not in the list yet)
 //		2. Respond ACK
 // - Receive a tx (RPC server)
 //		1. Add the tx to its mempool
-//		2. If sufficient tx, create a thread to mine a block
+//		2. If sufficient legal tx, create a thread to mine a block
+//		   (a block can include a tx and the txs spending its payments, in order, see blockchain.SelectTxs)
 //		3. Respond ACK
 // - Receive a block (RPC server)
 //		1. Check whether the block is legal
 // 		2. If legal, create a thread to append the block to the blockchain
 //		3. Respond ACK
+// - Keep a block whose prevhash hasn't arrived in the orphan pool (if its merkle root and pow are valid), and append it (and its waiting children) once the prevhash is appended
+// - Remove the txs confirmed by an appended block (or conflicting with it) from the mempool
+// - Give the txs of the blocks disconnected by a reorg back to the mempool
 // - Concurrency constraints:
 //		1. At any moment, only one thread can append a block to the blockchain (TODO: Is this necessary? Can DB guarantees consistency?)
 //		2. At any moment, only one thread can modify Addrs
 //		3. At any moment, only one thread can r/w mempool
 
-const THRESHOLD = 1
-const PORT = ":1132"
+const PENDING_EXPIRY = 5 * time.Minute // how long a tx of the miner locks the payments it spends if it is never confirmed
 
 var IP = map[string]string{
 	"8051": "10.1.0.91",
@@ -69,9 +81,16 @@ var IP = map[string]string{
 
 type Miner struct {
 	BC        *blockchain.BlockChain
+	Params    *blockchain.ChainParams
 	MID       string
 	Mempool   map[string]blockchain.Transaction // map: hash of a tx-> a tx
 	Addrs     map[string][]string               // map: machine_id -> wallets addresses
+	Orphans   *OrphanPool                       // blocks whose prevhash hasn't arrived yet
+	Keystore  *wallet.Keystore
+	HD        *wallet.HDWallet // derives the new wallets of `m`, nil until a seed is created or loaded
+	Spender   *wallet.Spender  // makes the txs of `m`, and locks the payments its pending txs spend
+	change    *wallet.Wallet   // the change wallet of the next tx of `m`, nil until derived (see change_wallet)
+	pass      string // the passphrase of the wallets of `m`
 	bc_lock   chan bool
 	mem_lock  chan bool
 	addr_lock chan bool
@@ -82,24 +101,31 @@ type MsgAddr struct {
 	MID  string
 }
 
+// Blocks and txs are sent in their canonical encoding (see blockchain/encoding.go)
 type MsgBlock struct {
-	B blockchain.Block
+	B []byte
 }
 
 type MsgTx struct {
-	Tx blockchain.Transaction
+	Tx []byte
 }
 
 type Rep struct {
 	R string
 }
 
-func NewMiner(machine_id string) *Miner {
+// `ks`: the keystore of the wallets of the miner, whose passphrase is `pass`
+func NewMiner(machine_id string, bc *blockchain.BlockChain, ks *wallet.Keystore, pass string) *Miner {
 	m := Miner{
-		BC:        blockchain.NewBlockChain(machine_id),
+		BC:        bc,
+		Params:    bc.Params,
 		MID:       machine_id,
 		Mempool:   make(map[string]blockchain.Transaction),
 		Addrs:     make(map[string][]string),
+		Orphans:   NewOrphanPool(),
+		Keystore:  ks,
+		Spender:   wallet.NewSpender(bc, PENDING_EXPIRY),
+		pass:      pass,
 		bc_lock:   make(chan bool, 1),
 		mem_lock:  make(chan bool, 1),
 		addr_lock: make(chan bool, 1),
@@ -109,24 +135,78 @@ func NewMiner(machine_id string) *Miner {
 	m.Addrs["8062"] = []string{}
 	m.Addrs["8063"] = []string{}
 	m.Addrs["8064"] = []string{}
+	m.BC.OnReorg(func(event *blockchain.ReorgEvent) {
+		// Called while appending a block, maybe while `mine` holds `mem_lock` and waits for the block to be appended
+		go m.restore_txs(event)
+	})
 	return &m
 }
 
+// Derive the next receive wallet of the seed of `m` (generating the seed first if there is none)
 func (m *Miner) CreateWallet() {
-	addr := wallet.NewWallet(m.MID)
-	fmt.Printf("Machine %s has created new wallet %x\n", m.MID, addr)////////////////////////////////////////////////////
+	var err error
+	if m.HD == nil {
+		m.HD, err = m.Keystore.NewSeed(m.pass)
+		if err != nil {
+			log.Fatal("Fail to create a seed, ", err)
+		}
+		fmt.Printf("Machine %s has created a new seed in keystore %s, back it up\n", m.MID, m.Keystore.Dir)
+	}
+	w, err := m.HD.NextReceive()
+	if err != nil {
+		log.Fatal("Fail to derive a wallet, ", err)
+	}
+	err = m.Keystore.Store(w, m.pass)
+	if err != nil {
+		log.Fatal("Fail to create a wallet, ", err)
+	}
+	addr := string(w.Address)
+	_, err = m.Keystore.Unlock(addr, m.pass)
+	if err != nil {
+		log.Fatal("Fail to unlock the new wallet, ", err)
+	}
+	fmt.Printf("Machine %s has created new wallet %s\n", m.MID, addr)////////////////////////////////////////////////////
 	m.broadcast_address(&MsgAddr{
-		Addr: addr,
+		Addr: w.Address,
 		MID:  m.MID,
 	})
 }
 
+// Unlock and broadcast the wallets of `m` that are already on disk (after a restart),
+// and the wallets of its seed that are used on the blockchain (after a restore from the seed)
+// Return the number of wallets loaded
+func (m *Miner) LoadWallets() int {
+	_, err := m.Keystore.ImportLegacy(m.MID, m.pass)
+	if err != nil {
+		log.Fatal("Fail to import the legacy wallets, ", err)
+	}
+	if m.Keystore.HasSeed() {
+		m.restore_wallets()
+	}
+	addrs := m.Keystore.List()
+	for _, addr := range addrs {
+		_, err := m.Keystore.Unlock(addr, m.pass)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("machine %s fails to unlock wallet %s: ", m.MID, addr), err)
+		}
+		fmt.Printf("Machine %s has loaded wallet %s\n", m.MID, addr)
+		if m.HD != nil && m.HD.IsChange(addr) {
+			continue // change addresses are not given out
+		}
+		m.broadcast_address(&MsgAddr{
+			Addr: []byte(addr),
+			MID:  m.MID,
+		})
+	}
+	return len(addrs)
+}
+
 func (m *Miner) StartService() {
 	rpc.Register(m)
 	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", PORT)
+	l, err := net.Listen("tcp", m.Params.Port)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("machine %s fails listen on port %s", m.MID, PORT), err)
+		log.Fatal(fmt.Sprintf("machine %s fails listen on port %s", m.MID, m.Params.Port), err)
 	}
 	//fmt.Printf("Server begins to start service\n")////////////////////////////////////////////////////////////////////////////////
 	rpc.Accept(l)
@@ -140,8 +220,22 @@ func (m *Miner) CreateGenisis() {
 
 func (m *Miner) HandleAddress(msg MsgAddr, rep *Rep) error {
 	//fmt.Printf("Machine %s begins to handle address msg %#v\n", m.MID, msg)/////////////////////////////////////////////
+	if _, err := utils.ParseAddress(string(msg.Addr)); err != nil {
+		rep.R = "ACK"
+		fmt.Printf("Machine %s drops address msg from machine %s: %v\n", m.MID, msg.MID, err)
+		return nil
+	}
 	m.addr_lock <- true
-	m.Addrs[msg.MID] = append(m.Addrs[msg.MID], string(msg.Addr))
+	known := false
+	for _, addr := range m.Addrs[msg.MID] {
+		if addr == string(msg.Addr) {
+			known = true // broadcast again after a restart
+			break
+		}
+	}
+	if !known {
+		m.Addrs[msg.MID] = append(m.Addrs[msg.MID], string(msg.Addr))
+	}
 	<-m.addr_lock
 	rep.R = "ACK"
 	//fmt.Printf("Machine %s finishes handling address msg\n", m.MID)////////////////////////////////
@@ -163,32 +257,38 @@ func (m *Miner) PrintMiner() string {
 
 func (m *Miner) broadcast_address(msg *MsgAddr) {
 	for dest, _ := range m.Addrs {
-		c, err := rpc.Dial("tcp", IP[dest]+PORT)
+		c, err := rpc.Dial("tcp", IP[dest]+m.Params.Port)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("machine %s fails to dial %s", m.MID, IP[dest]+PORT), err)
+			log.Fatal(fmt.Sprintf("machine %s fails to dial %s", m.MID, IP[dest]+m.Params.Port), err)
 		}
 		var rep Rep
 		//fmt.Printf("Machiene %s begins to broadcast address msg %#v to machine %s\n", m.MID, *msg, dest)/////////////////////////////////////
 		err = c.Call("Miner.HandleAddress", *msg, &rep)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("machine %s fails to call %s", m.MID, IP[dest]+PORT), err)
+			log.Fatal(fmt.Sprintf("machine %s fails to call %s", m.MID, IP[dest]+m.Params.Port), err)
 		}
 		if rep.R != "ACK" {
-			log.Fatal(fmt.Sprintf("machine %s fails get ACK reply", m.MID, IP[dest]+PORT))
+			log.Fatal(fmt.Sprintf("machine %s fails get ACK reply from %s", m.MID, IP[dest]+m.Params.Port))
 		}
 	}
 }
 
 func (m *Miner) HandleTx(msg MsgTx, rep *Rep) error {
-	fmt.Printf("Machine %s begins to handle tx msg %#v\n", m.MID, msg)///////////////////////////////
+	tx, err := blockchain.DecodeTransaction(msg.Tx)
+	if err != nil {
+		rep.R = "ACK"
+		fmt.Printf("Machine %s drops tx msg: %v\n", m.MID, err)
+		return nil
+	}
+	fmt.Printf("Machine %s begins to handle tx msg %x\n", m.MID, tx.Hash)///////////////////////////////
 	// if msg.Tx.Verify(m.BC) == false {
 	// 	rep.R = "ACK"
 	// 	fmt.Printf("False tx. Machine %s finishes handling tx msg\n", m.MID)///////////////////////////////
 	// 	return nil
 	// }
 	m.mem_lock <- true
-	key := hex.EncodeToString(msg.Tx.Hash)
-	m.Mempool[key] = msg.Tx
+	key := hex.EncodeToString(tx.Hash)
+	m.Mempool[key] = *tx
 	<-m.mem_lock
 	m.addr_lock <- true
 	num_wallets := len(m.Addrs[m.MID])
@@ -205,42 +305,38 @@ func (m *Miner) mine(to string, genisis bool) {
 	//fmt.Printf("Machine %s begins to mine\n", m.MID)///////////////////////////////////////////
 	if genisis {
 		txs := []*blockchain.Transaction{
-			blockchain.NewTransaction(wallet.ReadWallet(m.MID, to), []byte{}, 0, true, m.BC), // reward
+			blockchain.NewTransaction(m.wallet(to), "", 0, 0, true, m.BC), // reward
 		}
 		new_block := blockchain.NewBlock(txs, true, m.BC)
 		//fmt.Printf("address of block prevhash is %p\n", new_block.PrevHash)///////////////////////////////////////////////////
 		m.broadcast_block(&MsgBlock{
-			B: *new_block,
+			B: new_block.Encode(),
 		})
 		return
 	}
 	m.mem_lock <- true
-	var txs []*blockchain.Transaction
-	initiator_has_tx := make(map[string]bool) // map: address (pk) -> whether an initiator has a legal tx in the pool. Since we want to make sure that in each block an intiator of a tx occurs at most once
+	var pool []*blockchain.Transaction
 	for _, tx := range m.Mempool {
-		if tx.Verify(m.BC, []byte{}) == true {
-			_, ok := initiator_has_tx[hex.EncodeToString(tx.Initiator)]
-			if ok == false {
-				txs = append(txs, &tx)
-				initiator_has_tx[hex.EncodeToString(tx.Initiator)] = true
-			} else {
-				fmt.Printf("Initiator %x has created more than one txs in this round\n", tx.Initiator) /////////////////////////////////////////////
-			}
-
-		}
-		
+		tx := tx // `pool` keeps a pointer to it
+		pool = append(pool, &tx)
 	}
-	if len(txs) < THRESHOLD {
+	// The legal txs, a tx after the txs it spends, and no two spending the same payment
+	txs := m.BC.SelectTxs(pool)
+	if len(txs) < m.Params.Threshold {
 		<-m.mem_lock
 		fmt.Printf("Insufficient number of legal txs (%d legal txs) in mempool\n", len(txs)) //////////////////////////////////////////
 		return
 	}
-	reward_tx := blockchain.NewTransaction(wallet.ReadWallet(m.MID, to), []byte{}, 0, true, m.BC)
+	fees := blockchain.Amount(0)
+	for _, tx := range txs {
+		fees, _ = blockchain.AddAmounts(fees, tx.Fee())
+	}
+	reward_tx := blockchain.NewTransaction(m.wallet(to), "", 0, fees, true, m.BC) // claim the subsidy + fees
 	txs = append(txs, reward_tx) //reward
 	m.Mempool[hex.EncodeToString(reward_tx.Hash)] = *reward_tx
 	new_block := blockchain.NewBlock(txs, false, m.BC)
 	m.broadcast_block(&MsgBlock{
-		B: *new_block,
+		B: new_block.Encode(),
 	})
 	for _, tx := range txs {
 		delete(m.Mempool, hex.EncodeToString(tx.Hash))
@@ -249,8 +345,14 @@ func (m *Miner) mine(to string, genisis bool) {
 }
 
 func (m *Miner) HandleBlock(msg MsgBlock, rep *Rep) error {
-	fmt.Printf("Machine %s begins to handle the block msg %#v\n", m.MID, msg)/////////////////////////
-	m.append(&msg.B)
+	b, err := blockchain.DecodeBlock(msg.B)
+	if err != nil {
+		rep.R = "ACK"
+		fmt.Printf("Machine %s drops block msg: %v\n", m.MID, err)
+		return nil
+	}
+	fmt.Printf("Machine %s begins to handle the block msg %x\n", m.MID, b.Hash)/////////////////////////
+	m.append(b)
 	rep.R = "ACK"
 	fmt.Printf("Machine %s finishes handling the block msg\n", m.MID)//////////////////////////////////////////
 	return nil
@@ -259,25 +361,176 @@ func (m *Miner) HandleBlock(msg MsgBlock, rep *Rep) error {
 func (m *Miner) broadcast_block(msg *MsgBlock) {
 	for dest, _ := range m.Addrs {
 		//fmt.Printf("Machine %s begins to dial machine %s\n", m.MID, dest)/////////////////////////////////
-		c, err := rpc.Dial("tcp", IP[dest]+PORT)
+		c, err := rpc.Dial("tcp", IP[dest]+m.Params.Port)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("machine %s fails to dial %s", m.MID, IP[dest]+PORT), err)
+			log.Fatal(fmt.Sprintf("machine %s fails to dial %s", m.MID, IP[dest]+m.Params.Port), err)
 		}
 		var rep Rep
-		fmt.Printf("Machine %s begins to broadcast block msg %#v to machine %s\n", m.MID, *msg, dest)///////////////////////////////////
+		fmt.Printf("Machine %s begins to broadcast block msg (%d bytes) to machine %s\n", m.MID, len(msg.B), dest)///////////////////////////////////
 		err = c.Call("Miner.HandleBlock", *msg, &rep)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("machine %s fails to call %s", m.MID, IP[dest]+PORT), err)
+			log.Fatal(fmt.Sprintf("machine %s fails to call %s", m.MID, IP[dest]+m.Params.Port), err)
 		}
 		if rep.R != "ACK" {
-			log.Fatal(fmt.Sprintf("machine %s fails get ACK reply", m.MID, IP[dest]+PORT))
+			log.Fatal(fmt.Sprintf("machine %s fails get ACK reply from %s", m.MID, IP[dest]+m.Params.Port))
 		}
 		//fmt.Printf("Machine %s gets reply %s from the rpc call\n", m.MID, rep.R)//////////////////////////////////////////////////////
 	}
 }
 
+// Store the wallets of the seed of `m` that are used on the blockchain but missing from the keystore
+func (m *Miner) restore_wallets() {
+	var err error
+	m.HD, err = m.Keystore.UnlockSeed(m.pass)
+	if err != nil {
+		log.Fatal("Fail to unlock the seed, ", err)
+	}
+	used := m.BC.Addresses()
+	stored := make(map[string]bool)
+	for _, addr := range m.Keystore.List() {
+		stored[addr] = true
+	}
+	wallets, err := m.HD.Restore(func(addr string) bool {
+		return used[addr] || stored[addr]
+	})
+	if err != nil {
+		log.Fatal("Fail to restore the wallets of the seed, ", err)
+	}
+	for _, w := range wallets {
+		if stored[string(w.Address)] {
+			continue
+		}
+		err = m.Keystore.Store(w, m.pass)
+		if err != nil {
+			log.Fatal("Fail to restore a wallet, ", err)
+		}
+		fmt.Printf("Machine %s has restored wallet %s from its seed\n", m.MID, w.Address)
+	}
+}
+
+// The change wallet of the next tx of `m`: the next change wallet of its seed, stored and unlocked,
+// kept until a tx pays change to it (so that no change address is skipped when restoring from the seed)
+// nil if `m` has no seed (the change goes back to the wallet that pays)
+func (m *Miner) change_wallet() (*wallet.Wallet, error) {
+	if m.change != nil || m.HD == nil {
+		return m.change, nil
+	}
+	w, err := m.HD.NextChange()
+	if err != nil {
+		return nil, err
+	}
+	err = m.Keystore.Store(w, m.pass)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.Keystore.Unlock(string(w.Address), m.pass)
+	if err != nil {
+		return nil, err
+	}
+	m.change = w
+	return w, nil
+}
+
+// A copy of the txs in the mempool of `m`
+func (m *Miner) PendingTxs() []*blockchain.Transaction {
+	m.mem_lock <- true
+	defer func() { <-m.mem_lock }()
+	txs := make([]*blockchain.Transaction, 0, len(m.Mempool))
+	for _, tx := range m.Mempool {
+		tx := tx
+		txs = append(txs, &tx)
+	}
+	return txs
+}
+
+// The balances, unspent payments and histories of addresses, from the blockchain and the mempool of `m`
+func (m *Miner) Ledger() *wallet.Ledger {
+	return &wallet.Ledger{
+		BC:      m.BC,
+		Mempool: m.PendingTxs,
+	}
+}
+
+// The wallet of `m` of address `addr`, unlocked again if it has been locked
+func (m *Miner) wallet(addr string) *wallet.Wallet {
+	w, err := m.Keystore.Get(addr)
+	if err == wallet.ErrLocked {
+		w, err = m.Keystore.Unlock(addr, m.pass)
+	}
+	if err != nil {
+		log.Panic(fmt.Sprintf("machine %s fails to get wallet %s: %v", m.MID, addr, err))
+	}
+	return w
+}
+
+// Give the txs disconnected by a reorg back to the mempool (except those the new branch has confirmed)
+func (m *Miner) restore_txs(event *blockchain.ReorgEvent) {
+	fmt.Printf("Machine %s reorgs from %x to %x (depth %d), %d txs back to mempool\n", m.MID, event.OldTip, event.NewTip, event.Depth, len(event.Disconnected))
+	m.mem_lock <- true
+	for _, tx := range event.Disconnected {
+		m.Mempool[hex.EncodeToString(tx.Hash)] = *tx
+	}
+	m.prune_mempool()
+	<-m.mem_lock
+}
+
+// Remove the txs of the mempool with an income that is gone (see blockchain.UTXOSet.LiveTxs), i.e. the txs confirmed
+// by a block (of any miner), the txs conflicting with one, and the txs spending their payments
+// Rewards are kept (a miner keeps its reward there only while it mines the block)
+// The removed txs of `m` are dropped from its Spender
+// with `mem_lock` held
+func (m *Miner) prune_mempool() {
+	var pool []*blockchain.Transaction
+	for _, tx := range m.Mempool {
+		tx := tx // `pool` keeps a pointer to it
+		pool = append(pool, &tx)
+	}
+	live := make(map[string]bool)
+	for _, tx := range (blockchain.UTXOSet{BC: m.BC}).LiveTxs(pool) {
+		live[hex.EncodeToString(tx.Hash)] = true
+	}
+	for key, tx := range m.Mempool {
+		if !live[key] {
+			delete(m.Mempool, key)
+			m.Spender.Drop(tx.Hash) // if it is a tx of `m`
+		}
+	}
+}
+
 func (m *Miner) append(b *blockchain.Block) {
 	m.bc_lock <- true
-	m.BC.AppendBlock(b)
+	if !b.IsGenisis && !m.BC.HasBlock(b.PrevHash) {
+		if !b.VerifyOrphan(m.Params) {
+			fmt.Printf("Machine %s drops invalid orphan block %x\n", m.MID, b.Hash)
+			<-m.bc_lock
+			return
+		}
+		fmt.Printf("Machine %s keeps orphan block %x until block %x arrives\n", m.MID, b.Hash, b.PrevHash)
+		m.Orphans.Add(b)
+		<-m.bc_lock
+		return
+	}
+	// Append `b`, then the orphans waiting for it, recursively
+	blocks := []*blockchain.Block{b}
+	appended := false
+	for len(blocks) != 0 {
+		cur_block := blocks[0]
+		blocks = blocks[1:]
+		children := m.Orphans.Take(cur_block.Hash)
+		if m.BC.AppendBlock(cur_block) {
+			appended = true
+			blocks = append(blocks, children...)
+		} else if len(children) != 0 {
+			fmt.Printf("Machine %s drops %d orphan blocks of invalid block %x\n", m.MID, len(children), cur_block.Hash)
+		}
+	}
 	<-m.bc_lock
+	if appended {
+		// Maybe while `mine` holds `mem_lock` and waits for the block to be appended
+		go func() {
+			m.mem_lock <- true
+			m.prune_mempool()
+			<-m.mem_lock
+		}()
+	}
 }
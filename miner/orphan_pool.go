@@ -0,0 +1,118 @@
+package miner
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"Project2/blockchain"
+)
+
+// An OrphanPool stores:
+// - Blocks whose previous block is not in the blockchain yet (orphans), keyed by the hash of the missing block
+// - The time each orphan arrived
+// An OrphanPool can:
+// - Add an orphan:
+//		1. Drop the orphans that have waited longer than ORPHAN_TTL
+//		2. If the pool is full (MAX_ORPHANS), drop the orphan that arrived first
+// - Take (and remove) the orphans waiting for a block
+// - Concurrency constraints: the pool is only used while holding `bc_lock` of the miner
+
+const MAX_ORPHANS = 100
+const ORPHAN_TTL = 600 // an orphan is dropped after waiting 600s
+
+type OrphanPool struct {
+	orphans map[string][]*orphan // map: hex of the missing prevhash -> orphans waiting for it
+	size    int
+}
+
+type orphan struct {
+	B       *blockchain.Block
+	Arrival time.Time
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		orphans: make(map[string][]*orphan),
+		size:    0,
+	}
+}
+
+func (p *OrphanPool) Add(b *blockchain.Block) {
+	p.expire()
+	key := hex.EncodeToString(b.PrevHash)
+	for _, o := range p.orphans[key] {
+		if bytes.Compare(o.B.Hash, b.Hash) == 0 {
+			return
+		}
+	}
+	if p.size >= MAX_ORPHANS {
+		p.drop_oldest()
+	}
+	p.orphans[key] = append(p.orphans[key], &orphan{
+		B:       b,
+		Arrival: time.Now(),
+	})
+	p.size += 1
+}
+
+// Take the orphans whose prevhash is `hash`
+func (p *OrphanPool) Take(hash []byte) []*blockchain.Block {
+	key := hex.EncodeToString(hash)
+	var children []*blockchain.Block
+	for _, o := range p.orphans[key] {
+		children = append(children, o.B)
+	}
+	p.size -= len(p.orphans[key])
+	delete(p.orphans, key)
+	return children
+}
+
+func (p *OrphanPool) Size() int {
+	return p.size
+}
+
+func (p *OrphanPool) expire() {
+	for key, waiting := range p.orphans {
+		var kept []*orphan
+		for _, o := range waiting {
+			if time.Since(o.Arrival) < time.Duration(ORPHAN_TTL)*time.Second {
+				kept = append(kept, o)
+			} else {
+				fmt.Printf("Orphan block %x expires\n", o.B.Hash)
+			}
+		}
+		p.size -= len(waiting) - len(kept)
+		if len(kept) == 0 {
+			delete(p.orphans, key)
+		} else {
+			p.orphans[key] = kept
+		}
+	}
+}
+
+func (p *OrphanPool) drop_oldest() {
+	var oldest_key string
+	oldest_idx := -1
+	for key, waiting := range p.orphans {
+		for idx, o := range waiting {
+			if oldest_idx == -1 || o.Arrival.Before(p.orphans[oldest_key][oldest_idx].Arrival) {
+				oldest_key = key
+				oldest_idx = idx
+			}
+		}
+	}
+	if oldest_idx == -1 {
+		return
+	}
+	waiting := p.orphans[oldest_key]
+	fmt.Printf("Orphan pool is full, drop orphan block %x\n", waiting[oldest_idx].B.Hash)
+	waiting = append(waiting[:oldest_idx], waiting[oldest_idx+1:]...)
+	if len(waiting) == 0 {
+		delete(p.orphans, oldest_key)
+	} else {
+		p.orphans[oldest_key] = waiting
+	}
+	p.size -= 1
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// An Address is the Base58 form of version (1B) | hash_pk (20B) | checksum (4B), see PKToAdress
+// An Address from ParseAddress is always valid, so a typo in an address is caught before any coin is sent to it.
+
+const ADDRESS_VERSION = 0x00
+const HASH_PK_LEN = 20 // RIPEMD160
+const CHECKSUM_LEN = 4
+
+type Address string
+
+// Parse `s` as an address
+// Return an error if `s` is not Base58, or its version, length or checksum is wrong
+func ParseAddress(s string) (Address, error) {
+	decoded, err := decode_address(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", s, err)
+	}
+	if len(decoded) != 1+HASH_PK_LEN+CHECKSUM_LEN {
+		return "", fmt.Errorf("invalid address %q: %d bytes, expect %d", s, len(decoded), 1+HASH_PK_LEN+CHECKSUM_LEN)
+	}
+	if decoded[0] != ADDRESS_VERSION {
+		return "", fmt.Errorf("invalid address %q: version %d, expect %d", s, decoded[0], ADDRESS_VERSION)
+	}
+	version_hashpk := decoded[:1+HASH_PK_LEN]
+	if bytes.Compare(address_checksum(version_hashpk), decoded[1+HASH_PK_LEN:]) != 0 {
+		return "", fmt.Errorf("invalid address %q: wrong checksum", s)
+	}
+	// Only the form given by Base58Encode, so that an address has one string
+	if string(Base58Encode(decoded)) != s {
+		return "", fmt.Errorf("invalid address %q: not in canonical form", s)
+	}
+	return Address(s), nil
+}
+
+// Base58Encode writes a single '1' for the version, however many zero bytes follow it,
+// so the zero bytes at the start of hash_pk are lost in Base58Decode: put them back
+func decode_address(s string) ([]byte, error) {
+	decoded, err := Base58Decode([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < 1+HASH_PK_LEN+CHECKSUM_LEN && decoded[0] == ADDRESS_VERSION {
+		padding := make([]byte, 1+HASH_PK_LEN+CHECKSUM_LEN-len(decoded))
+		decoded = append(append(decoded[:1:1], padding...), decoded[1:]...)
+	}
+	return decoded, nil
+}
+
+// The hash of the pk of the address
+func (addr Address) HashPK() []byte {
+	decoded, err := decode_address(string(addr))
+	if err != nil || len(decoded) != 1+HASH_PK_LEN+CHECKSUM_LEN {
+		return nil
+	}
+	return decoded[1 : 1+HASH_PK_LEN]
+}
+
+// The address as stored in a wallet or a payment
+func (addr Address) Bytes() []byte {
+	return []byte(addr)
+}
+
+func (addr Address) String() string {
+	return string(addr)
+}
@@ -3,6 +3,7 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	"math/big"
 )
 
@@ -26,7 +27,7 @@ func Base58Encode(input []byte) []byte {
 	}
 
 	// https://en.bitcoin.it/wiki/Base58Check_encoding#Version_bytes
-	if input[0] == 0x00 {
+	if len(input) != 0 && input[0] == 0x00 {
 		result = append(result, b58Alphabet[0])
 	}
 
@@ -36,11 +37,18 @@ func Base58Encode(input []byte) []byte {
 }
 
 // Base58Decode decodes Base58-encoded data
-func Base58Decode(input []byte) []byte {
+// Return an error if `input` is empty or has a character out of the alphabet
+func Base58Decode(input []byte) ([]byte, error) {
+	if len(input) == 0 {
+		return nil, fmt.Errorf("empty base58 string")
+	}
 	result := big.NewInt(0)
 
 	for _, b := range input {
 		charIndex := bytes.IndexByte(b58Alphabet, b)
+		if charIndex < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", b)
+		}
 		result.Mul(result, big.NewInt(58))
 		result.Add(result, big.NewInt(int64(charIndex)))
 	}
@@ -51,7 +59,7 @@ func Base58Decode(input []byte) []byte {
 		decoded = append([]byte{0x00}, decoded...)
 	}
 
-	return decoded
+	return decoded, nil
 }
 
 // ReverseBytes reverses a byte array
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"math/big"
+)
+
+// The compact form of a 256-bit pow threshold (as `nBits` in Bitcoin):
+// exponent (1B) | mantissa (3B), threshold = mantissa * 256^(exponent - 3)
+// The mantissa is kept below 0x800000 (the sign bit in Bitcoin), and thresholds are never negative here.
+
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+	n := big.NewInt(mantissa)
+	if exponent <= 3 {
+		return n.Rsh(n, 8*(3-exponent))
+	}
+	return n.Lsh(n, 8*(exponent-3))
+}
+
+// The compact form of `n`, rounded down
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() <= 0 {
+		return 0
+	}
+	exponent := uint(len(n.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(n, 8*(exponent-3)).Uint64())
+	}
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent += 1
+	}
+	return uint32(exponent<<24) | mantissa
+}
@@ -4,23 +4,43 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/sha256"
+	"fmt"
 	"math/big"
 	"log"
 
 	"github.com/btcsuite/golangcrypto/ripemd160"
 )
 
-func RawPK(pk []byte) ecdsa.PublicKey {
-	x := big.Int{}
-	y := big.Int{}
-	x.SetBytes(pk[:len(pk) / 2])
-	y.SetBytes(pk[len(pk) / 2:])
+// The encoding of a public key on P256 is SEC1:
+// - compressed (33B): 0x02 or 0x03 (the parity of y) | x (32B)
+// - uncompressed (65B): 0x04 | x (32B) | y (32B)
+// x and y are big-endian and zero-padded, so the encoding of a key has a fixed width.
+// Keys are encoded compressed; both forms are decoded. A key (and its address) is always the bytes of its encoding.
+const PK_LEN = 33
 
-	return ecdsa.PublicKey{
-		Curve: elliptic.P256(),
-		X: &x,
-		Y: &y,
+// Encode `pk` in SEC1 compressed form
+func EncodePublicKey(pk *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(elliptic.P256(), pk.X, pk.Y)
+}
+
+// Decode a public key on P256 in SEC1 compressed or uncompressed form
+// Return an error if `pk` is of neither form, or is not a point on the curve
+func DecodePublicKey(pk []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+	var x, y *big.Int
+	if len(pk) == PK_LEN {
+		x, y = elliptic.UnmarshalCompressed(curve, pk)
+	} else if len(pk) == 2*PK_LEN-1 {
+		x, y = elliptic.Unmarshal(curve, pk)
+	}
+	if x == nil {
+		return nil, fmt.Errorf("invalid public key of %d bytes", len(pk))
 	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X: x,
+		Y: y,
+	}, nil
 }
 
 // Compute the hash of `pk`
@@ -43,20 +63,62 @@ func HashPublicKey(pk []byte) []byte {
 // hash_pk = hash(pk)
 // checksum = the first 4 bytes of SHA256(SHA256(version | pk_hash))
 func PKToAdress(pk []byte) []byte {
-	hash_pk := HashPublicKey(pk)
-	version_hashpk := append([]byte{byte(0x00)}, hash_pk...)
-	first := sha256.Sum256(version_hashpk)
-	second := sha256.Sum256(first[:])
-	checksum := second[0:4]
-	addr := append(version_hashpk, checksum...)
+	return HashPKToAddress(HashPublicKey(pk))
+}
+
+// Compute the address of the public key whose hash is `hash_pk`
+func HashPKToAddress(hash_pk []byte) []byte {
+	version_hashpk := append([]byte{ADDRESS_VERSION}, hash_pk...)
+	addr := append(version_hashpk, address_checksum(version_hashpk)...)
 
 	return Base58Encode(addr)
 }
 
 // Compute the hash_pk from `addr`
-func AddressToHashPK(addr []byte) []byte {
-	hash_pk := Base58Decode(addr)
-	hash_pk = hash_pk[1:len(hash_pk) - 4]
+// Return an error if `addr` is not a valid address (see ParseAddress)
+func AddressToHashPK(addr []byte) ([]byte, error) {
+	parsed, err := ParseAddress(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	return parsed.HashPK(), nil
+}
 
-	return hash_pk
-}
\ No newline at end of file
+// The first 4 bytes of SHA256(SHA256(version | pk_hash))
+func address_checksum(version_hashpk []byte) []byte {
+	first := sha256.Sum256(version_hashpk)
+	second := sha256.Sum256(first[:])
+	return second[0:CHECKSUM_LEN]
+}
+
+// Layout of a signature: r (32B) | s (32B), big-endian and zero-padded, with s <= N/2 (low-S)
+// Since (r, N - s) is also a valid signature of the same message, only the low s is accepted,
+// so that a signature has exactly one encoding.
+const SIG_LEN = 64
+
+// Encode the signature (r, s) on P256, turning s into low-S
+func EncodeSignature(r *big.Int, s *big.Int) []byte {
+	n := elliptic.P256().Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s = new(big.Int).Sub(n, s)
+	}
+	sig := make([]byte, SIG_LEN)
+	r.FillBytes(sig[:SIG_LEN/2])
+	s.FillBytes(sig[SIG_LEN/2:])
+	return sig
+}
+
+// Decode a signature on P256
+// Return false if `sig` is not SIG_LEN bytes, or r or s is not in [1, N - 1], or s is not low-S
+func DecodeSignature(sig []byte) (*big.Int, *big.Int, bool) {
+	if len(sig) != SIG_LEN {
+		return nil, nil, false
+	}
+	n := elliptic.P256().Params().N
+	r := new(big.Int).SetBytes(sig[:SIG_LEN/2])
+	s := new(big.Int).SetBytes(sig[SIG_LEN/2:])
+	if r.Sign() <= 0 || r.Cmp(n) >= 0 || s.Sign() <= 0 || s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		return nil, nil, false
+	}
+	return r, s, true
+}
@@ -0,0 +1,299 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"Project2/utils"
+)
+
+// Hierarchical deterministic (HD) wallets: every wallet is derived from one seed, so backing up the seed backs up all of them.
+// Keys are derived as in BIP32, on P256:
+// - Master key: I = HMAC-SHA512("Project2 seed", seed), sk = I[:32], chain code = I[32:]
+// - Child i of (sk, c):
+//		hardened (i >= HARDENED):	I = HMAC-SHA512(c, 0x00 | sk (32B) | i (4B))
+//		normal:						I = HMAC-SHA512(c, pk (SEC1 compressed) | i (4B))
+//		child sk = I[:32] + sk mod N, child chain code = I[32:]
+//   The child pk of a normal child can also be derived from the pk alone: child pk = I[:32] * G + pk
+//   A child whose I[:32] >= N or whose sk is 0 is invalid (with probability < 2^-127), and its index is skipped.
+// The wallets of an HDWallet are on two chains of the account m/0':
+// - m/0'/0/i: receive addresses, given out to be paid
+// - m/0'/1/i: change addresses, paid the change of the txs of the wallets (never given out)
+// Restoring from a seed derives the addresses of both chains until GAP_LIMIT addresses in a row are unused on the blockchain.
+
+const HARDENED = uint32(1) << 31
+const RECEIVE_CHAIN = 0
+const CHANGE_CHAIN = 1
+const ACCOUNT_PATH = "m/0'"
+const GAP_LIMIT = 20
+const SEED_LEN = 32 // the length of a new seed; seeds of 16 to 64 bytes are accepted
+
+var master_hmac_key = []byte("Project2 seed")
+
+var ErrInvalidChild = errors.New("invalid child key")
+
+// An ExtendedKey is a key and its chain code, from which its children are derived
+// - Key: the sk (32B, big-endian) if Private, the pk (SEC1 compressed) otherwise
+type ExtendedKey struct {
+	Key       []byte
+	ChainCode []byte
+	Depth     uint8
+	Index     uint32 // the index of the key in its parent
+	Private   bool
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("seed of %d bytes, expect 16 to 64", len(seed))
+	}
+	I := hmac_sha512(master_hmac_key, seed)
+	k := new(big.Int).SetBytes(I[:32])
+	if k.Sign() == 0 || k.Cmp(curve_order()) >= 0 {
+		return nil, ErrInvalidChild
+	}
+	return &ExtendedKey{
+		Key:       I[:32],
+		ChainCode: I[32:],
+		Private:   true,
+	}, nil
+}
+
+// Derive the child `i` of `k`
+// Return ErrInvalidChild if the child is invalid (use the next index instead)
+func (k *ExtendedKey) Child(i uint32) (*ExtendedKey, error) {
+	var data []byte
+	if i >= HARDENED {
+		if !k.Private {
+			return nil, fmt.Errorf("cannot derive hardened child %d from a public key", i-HARDENED)
+		}
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		data = k.PublicKey()
+	}
+	data = binary.BigEndian.AppendUint32(data, i)
+	I := hmac_sha512(k.ChainCode, data)
+	N := curve_order()
+	tweak := new(big.Int).SetBytes(I[:32])
+	if tweak.Cmp(N) >= 0 {
+		return nil, ErrInvalidChild
+	}
+	child := &ExtendedKey{
+		ChainCode: I[32:],
+		Depth:     k.Depth + 1,
+		Index:     i,
+		Private:   k.Private,
+	}
+	if k.Private {
+		sk := new(big.Int).Add(tweak, new(big.Int).SetBytes(k.Key))
+		sk.Mod(sk, N)
+		if sk.Sign() == 0 {
+			return nil, ErrInvalidChild
+		}
+		child.Key = sk.FillBytes(make([]byte, 32))
+	} else {
+		parent, err := utils.DecodePublicKey(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		curve := elliptic.P256()
+		x, y := curve.ScalarBaseMult(I[:32])
+		x, y = curve.Add(x, y, parent.X, parent.Y)
+		if x.Sign() == 0 && y.Sign() == 0 {
+			return nil, ErrInvalidChild
+		}
+		child.Key = utils.EncodePublicKey(&ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+	}
+	return child, nil
+}
+
+// Derive the key of `path` (e.g. "m/0'/0/5", ' for a hardened index) from the master key `k`
+func (k *ExtendedKey) Derive(path string) (*ExtendedKey, error) {
+	indexes, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range indexes {
+		k, err = k.Child(i)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return k, nil
+}
+
+// The pk of `k`, in SEC1 compressed form
+func (k *ExtendedKey) PublicKey() []byte {
+	if !k.Private {
+		return k.Key
+	}
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(k.Key)
+	return utils.EncodePublicKey(&ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+}
+
+// The public key of `k`, from which only its normal children (and their pks) can be derived
+func (k *ExtendedKey) Neuter() *ExtendedKey {
+	return &ExtendedKey{
+		Key:       k.PublicKey(),
+		ChainCode: k.ChainCode,
+		Depth:     k.Depth,
+		Index:     k.Index,
+	}
+}
+
+// The wallet of the sk of `k`
+func (k *ExtendedKey) Wallet() (*Wallet, error) {
+	if !k.Private {
+		return nil, fmt.Errorf("a public key has no wallet")
+	}
+	curve := elliptic.P256()
+	sk := &ecdsa.PrivateKey{
+		D: new(big.Int).SetBytes(k.Key),
+	}
+	sk.PublicKey.Curve = curve
+	sk.PublicKey.X, sk.PublicKey.Y = curve.ScalarBaseMult(k.Key)
+	serialized_sk, err := x509.MarshalECPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	return new_wallet(serialized_sk, &sk.PublicKey), nil
+}
+
+// Parse a derivation path "m/i/j'/..." into its indexes (HARDENED added to the hardened ones)
+func ParsePath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("invalid path %q: must start with m", path)
+	}
+	var indexes []uint32
+	for _, part := range parts[1:] {
+		hardened := strings.HasSuffix(part, "'")
+		n, err := strconv.ParseUint(strings.TrimSuffix(part, "'"), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: index %q", path, part)
+		}
+		i := uint32(n)
+		if hardened {
+			i += HARDENED
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// An HDWallet derives the wallets of a seed
+// - Next: the next unused index of the receive chain and of the change chain
+type HDWallet struct {
+	Seed    []byte
+	Next    [2]uint32
+	account *ExtendedKey
+}
+
+func NewHDWallet(seed []byte) (*HDWallet, error) {
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	account, err := master.Derive(ACCOUNT_PATH)
+	if err != nil {
+		return nil, err
+	}
+	return &HDWallet{
+		Seed:    seed,
+		account: account,
+	}, nil
+}
+
+// The wallet m/0'/`chain`/`index`
+func (hd *HDWallet) Wallet(chain uint32, index uint32) (*Wallet, error) {
+	k, err := hd.account.Child(chain)
+	if err != nil {
+		return nil, err
+	}
+	k, err = k.Child(index)
+	if err != nil {
+		return nil, err
+	}
+	return k.Wallet()
+}
+
+// Derive the next receive wallet
+func (hd *HDWallet) NextReceive() (*Wallet, error) {
+	return hd.next(RECEIVE_CHAIN)
+}
+
+// Derive the next change wallet
+func (hd *HDWallet) NextChange() (*Wallet, error) {
+	return hd.next(CHANGE_CHAIN)
+}
+
+// Whether `addr` is a change address derived so far (below Next of the change chain)
+func (hd *HDWallet) IsChange(addr string) bool {
+	for i := uint32(0); i < hd.Next[CHANGE_CHAIN]; i++ {
+		w, err := hd.Wallet(CHANGE_CHAIN, i)
+		if err == nil && string(w.Address) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (hd *HDWallet) next(chain uint32) (*Wallet, error) {
+	for hd.Next[chain] < HARDENED {
+		i := hd.Next[chain]
+		hd.Next[chain]++
+		w, err := hd.Wallet(chain, i)
+		if err != ErrInvalidChild {
+			return w, err
+		}
+	}
+	return nil, fmt.Errorf("chain %d of the wallet is used up", chain)
+}
+
+// Find the wallets of the seed that are used, i.e. `used` of their addresses is true,
+// scanning each chain until GAP_LIMIT addresses in a row are unused
+// Next is moved past the last used wallet of each chain
+func (hd *HDWallet) Restore(used func(addr string) bool) ([]*Wallet, error) {
+	var wallets []*Wallet
+	for _, chain := range []uint32{RECEIVE_CHAIN, CHANGE_CHAIN} {
+		gap := 0
+		for i := uint32(0); gap < GAP_LIMIT && i < HARDENED; i++ {
+			w, err := hd.Wallet(chain, i)
+			if err == ErrInvalidChild {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !used(string(w.Address)) {
+				gap++
+				continue
+			}
+			gap = 0
+			wallets = append(wallets, w)
+			if hd.Next[chain] <= i {
+				hd.Next[chain] = i + 1
+			}
+		}
+	}
+	return wallets, nil
+}
+
+func hmac_sha512(key []byte, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func curve_order() *big.Int {
+	return elliptic.P256().Params().N
+}
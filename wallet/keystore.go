@@ -0,0 +1,356 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/golangcrypto/scrypt"
+
+	"Project2/utils"
+)
+
+// A Keystore stores:
+// - Dir: the directory of the key files, one file per wallet, named by its address,
+//		and the file SEED_FILE of the seed of the HD wallets (see hd.go), if any
+// - Timeout: how long Unlock keeps a wallet unlocked (forever if 0)
+// - The wallets that are unlocked, in memory
+// A key file stores the address and the pk of a wallet in clear, and its sk (or the seed) encrypted:
+//		key = scrypt(passphrase, salt, N, r, p), the sk is sealed by AES-256-GCM with the key, bound to the address
+// A Keystore can:
+// - Create a wallet and store it, encrypted with a passphrase
+// - List the addresses of its wallets
+// - Unlock a wallet with its passphrase (the wallet is kept in memory until Timeout or Lock), and Lock it again
+// - Change the passphrase of a wallet
+// - Store the seed of the HD wallets, encrypted like a wallet
+// - Import the legacy (unencrypted) wallet files of a machine
+
+const KEYSTORE_VERSION = 1
+const SEED_FILE = "seed"
+const SCRYPT_N = 1 << 15
+const SCRYPT_R = 8
+const SCRYPT_P = 1
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+var ErrLocked = errors.New("wallet is locked")
+
+type Keystore struct {
+	Dir      string
+	Timeout  time.Duration
+	lock     sync.Mutex
+	unlocked map[string]*unlocked_wallet // map: address -> unlocked wallet
+}
+
+type unlocked_wallet struct {
+	wallet *Wallet
+	timer  *time.Timer // nil if unlocked forever
+}
+
+// The content of a key file
+type key_file struct {
+	Version    int
+	Address    string
+	PK         []byte
+	Salt       []byte
+	N          int
+	R          int
+	P          int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Open the keystore in `dir`, or create it if there is none
+func NewKeystore(dir string, timeout time.Duration) (*Keystore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open keystore %s: %v", dir, err)
+	}
+	return &Keystore{
+		Dir:      dir,
+		Timeout:  timeout,
+		unlocked: make(map[string]*unlocked_wallet),
+	}, nil
+}
+
+// Create a wallet, encrypted with `pass`
+// Return its address
+func (ks *Keystore) NewWallet(pass string) (utils.Address, error) {
+	w := NewWallet()
+	err := ks.Store(w, pass)
+	if err != nil {
+		return "", err
+	}
+	return utils.Address(w.Address), nil
+}
+
+// Store `w`, encrypted with `pass`
+func (ks *Keystore) Store(w *Wallet, pass string) error {
+	return ks.seal(string(w.Address), w.PK, w.SK, pass)
+}
+
+// Whether the keystore has a seed of HD wallets (see hd.go)
+func (ks *Keystore) HasSeed() bool {
+	_, err := os.Stat(ks.path(SEED_FILE))
+	return err == nil
+}
+
+// Generate a seed of HD wallets, encrypted with `pass`
+func (ks *Keystore) NewSeed(pass string) (*HDWallet, error) {
+	seed := make([]byte, SEED_LEN)
+	_, err := rand.Read(seed)
+	if err != nil {
+		return nil, err
+	}
+	return ks.StoreSeed(seed, pass)
+}
+
+// Store `seed` (e.g. restored from a backup), encrypted with `pass`
+// Return an error if the keystore already has another seed, whose wallets would be lost
+func (ks *Keystore) StoreSeed(seed []byte, pass string) (*HDWallet, error) {
+	hd, err := NewHDWallet(seed)
+	if err != nil {
+		return nil, err
+	}
+	if ks.HasSeed() {
+		return nil, fmt.Errorf("keystore %s already has a seed", ks.Dir)
+	}
+	err = ks.seal(SEED_FILE, nil, seed, pass)
+	if err != nil {
+		return nil, err
+	}
+	return hd, nil
+}
+
+// Decrypt the seed with `pass`
+func (ks *Keystore) UnlockSeed(pass string) (*HDWallet, error) {
+	_, seed, err := ks.open(SEED_FILE, pass)
+	if err != nil {
+		return nil, err
+	}
+	return NewHDWallet(seed)
+}
+
+// Write the key file `name`, with `secret` encrypted with `pass`
+func (ks *Keystore) seal(name string, pk []byte, secret []byte, pass string) error {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	kf := &key_file{
+		Version: KEYSTORE_VERSION,
+		Address: name,
+		PK:      pk,
+		Salt:    salt,
+		N:       SCRYPT_N,
+		R:       SCRYPT_R,
+		P:       SCRYPT_P,
+	}
+	gcm, err := kf.cipher(pass)
+	if err != nil {
+		return err
+	}
+	kf.Nonce = make([]byte, gcm.NonceSize())
+	_, err = rand.Read(kf.Nonce)
+	if err != nil {
+		return err
+	}
+	kf.Ciphertext = gcm.Seal(nil, kf.Nonce, secret, []byte(kf.Address))
+	data, err := json.MarshalIndent(kf, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a crash never leaves a broken key file
+	tmp := ks.path(name) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("fail to store %s: %v", name, err)
+	}
+	return os.Rename(tmp, ks.path(name))
+}
+
+// Return the addresses of the wallets in the keystore
+func (ks *Keystore) List() []string {
+	filenames, err := filepath.Glob(filepath.Join(ks.Dir, "*"))
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, filename := range filenames {
+		addr := filepath.Base(filename)
+		if _, err := utils.ParseAddress(addr); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Decrypt the wallet of `addr` with `pass`, and keep it unlocked for Timeout
+func (ks *Keystore) Unlock(addr string, pass string) (*Wallet, error) {
+	w, err := ks.decrypt(addr, pass)
+	if err != nil {
+		return nil, err
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.lock_locked(addr)
+	u := &unlocked_wallet{
+		wallet: w,
+	}
+	if ks.Timeout > 0 {
+		u.timer = time.AfterFunc(ks.Timeout, func() {
+			ks.lock.Lock()
+			defer ks.lock.Unlock()
+			// The wallet may have been locked and unlocked again since
+			if ks.unlocked[addr] == u {
+				ks.lock_locked(addr)
+			}
+		})
+	}
+	ks.unlocked[addr] = u
+	return w.copy(), nil
+}
+
+// Return the wallet of `addr` if it is unlocked, ErrLocked otherwise
+func (ks *Keystore) Get(addr string) (*Wallet, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	u, ok := ks.unlocked[addr]
+	if !ok {
+		return nil, ErrLocked
+	}
+	return u.wallet.copy(), nil
+}
+
+func (ks *Keystore) Lock(addr string) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.lock_locked(addr)
+}
+
+// Change the passphrase of the wallet of `addr` (or of the seed if `addr` is SEED_FILE) from `old_pass` to `new_pass`
+func (ks *Keystore) ChangePassphrase(addr string, old_pass string, new_pass string) error {
+	if addr != SEED_FILE {
+		if _, err := utils.ParseAddress(addr); err != nil {
+			return err
+		}
+	}
+	kf, secret, err := ks.open(addr, old_pass)
+	if err != nil {
+		return err
+	}
+	return ks.seal(addr, kf.PK, secret, new_pass)
+}
+
+// Import the legacy wallet files of `machine_id` (see wallet.go), encrypted with `pass`
+// A legacy file is removed once its wallet is stored in the keystore
+// Return the number of wallets imported
+func (ks *Keystore) ImportLegacy(machine_id string, pass string) (int, error) {
+	wallets, filenames, err := read_legacy_wallets(machine_id)
+	if err != nil {
+		return 0, err
+	}
+	for i, w := range wallets {
+		err = ks.Store(w, pass)
+		if err != nil {
+			return i, err
+		}
+		err = os.Remove(filenames[i])
+		if err != nil {
+			return i, err
+		}
+		fmt.Printf("Wallet %s imported into keystore %s as %s\n", filenames[i], ks.Dir, w.Address)
+	}
+	return len(wallets), nil
+}
+
+func (ks *Keystore) path(addr string) string {
+	return filepath.Join(ks.Dir, addr)
+}
+
+func (ks *Keystore) decrypt(addr string, pass string) (*Wallet, error) {
+	if _, err := utils.ParseAddress(addr); err != nil {
+		return nil, err
+	}
+	kf, sk, err := ks.open(addr, pass)
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{
+		SK:      sk,
+		PK:      kf.PK,
+		Address: []byte(kf.Address),
+	}, nil
+}
+
+// Read the key file `name`, and decrypt its secret with `pass`
+func (ks *Keystore) open(name string, pass string) (*key_file, []byte, error) {
+	data, err := ioutil.ReadFile(ks.path(name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to read %s: %v", name, err)
+	}
+	var kf key_file
+	err = json.Unmarshal(data, &kf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to read %s: %v", name, err)
+	}
+	if kf.Version != KEYSTORE_VERSION || kf.Address != name {
+		return nil, nil, fmt.Errorf("fail to read %s: version %d of %s", name, kf.Version, kf.Address)
+	}
+	gcm, err := kf.cipher(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := gcm.Open(nil, kf.Nonce, kf.Ciphertext, []byte(kf.Address))
+	if err != nil {
+		return nil, nil, ErrWrongPassphrase
+	}
+	return &kf, secret, nil
+}
+
+// Forget the unlocked wallet of `addr`, with `ks.lock` held
+func (ks *Keystore) lock_locked(addr string) {
+	u, ok := ks.unlocked[addr]
+	if !ok {
+		return
+	}
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	for i := range u.wallet.SK {
+		u.wallet.SK[i] = 0
+	}
+	delete(ks.unlocked, addr)
+}
+
+// A copy of `w`, which stays valid after `w` is locked
+func (w *Wallet) copy() *Wallet {
+	return &Wallet{
+		SK:      append([]byte{}, w.SK...),
+		PK:      w.PK,
+		Address: w.Address,
+	}
+}
+
+// The AES-256-GCM cipher of the key derived from `pass`
+func (kf *key_file) cipher(pass string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(pass), kf.Salt, kf.N, kf.R, kf.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
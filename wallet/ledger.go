@@ -0,0 +1,241 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"Project2/blockchain"
+	"Project2/utils"
+)
+
+// A Ledger tells what an address owns and what it has done, from:
+// - BC: the blockchain (the main chain and its "utxo" index)
+// - Mempool: the txs that are not in the blockchain yet (e.g. the mempool of a miner), nil if there is none
+// A Ledger can:
+// - Compute the balance of an address: confirmed, immature, unconfirmed incoming and unconfirmed outgoing amounts
+// - List the unspent payments to an address, on the chain or in the mempool
+// - List the txs that pay to or are initiated by an address, on the chain or in the mempool
+// A payment has 1 confirmation in the block at the tip, 2 in the block below, ..., and 0 in the mempool.
+// Rewards in the mempool are ignored (a miner keeps its reward there only while it mines the block), and so are the txs
+// of the mempool that are already in a block or conflict with one (an income neither unspent on the chain nor paid by the mempool).
+
+type Ledger struct {
+	BC      *blockchain.BlockChain
+	Mempool func() []*blockchain.Transaction
+}
+
+// The balance of an address
+// - Confirmed: spendable now, i.e. on the chain with enough confirmations, mature and not spent by the mempool
+// - Immature: rewards on the chain with enough confirmations that are not mature yet
+// - Unconfirmed: incoming, i.e. on the chain with too few confirmations, or paid by the mempool
+// - Spending: outgoing, i.e. on the chain but spent by the mempool
+type Balance struct {
+	Confirmed   blockchain.Amount
+	Immature    blockchain.Amount
+	Unconfirmed blockchain.Amount
+	Spending    blockchain.Amount
+}
+
+// An unspent payment to an address
+// - Height: of the block of its tx, -1 if its tx is in the mempool
+// - Mature: whether it can be spent by the block on top of the tip
+type Unspent struct {
+	HashTx        []byte
+	Idx           int
+	Amount        blockchain.Amount
+	Height        int
+	Confirmations int
+	IsReward      bool
+	Mature        bool
+}
+
+// A tx of an address
+// - Height: of the block of the tx, -1 if the tx is in the mempool
+// - Time: of the block of the tx, 0 if the tx is in the mempool
+// - Received: the payments of the tx to the address (including the change of its own tx)
+// - Sent: the incomes of the tx, if the address is its initiator
+// - Net: Received - Sent
+type HistoryEntry struct {
+	HashTx        []byte
+	Height        int
+	Confirmations int
+	Time          int64
+	Received      blockchain.Amount
+	Sent          blockchain.Amount
+	Net           int64
+}
+
+// The balance of `addr`, counting payments on the chain as confirmed once they have `min_conf` confirmations (at least 1)
+func (l *Ledger) Balance(addr utils.Address, min_conf int) Balance {
+	if min_conf < 1 {
+		min_conf = 1
+	}
+	var balance Balance
+	confirmed, pending, spending := l.unspent(addr)
+	for _, u := range confirmed {
+		switch {
+		case u.Confirmations < min_conf:
+			balance.Unconfirmed = blockchain.CapAmounts(balance.Unconfirmed, u.Amount)
+		case !u.Mature:
+			balance.Immature = blockchain.CapAmounts(balance.Immature, u.Amount)
+		default:
+			balance.Confirmed = blockchain.CapAmounts(balance.Confirmed, u.Amount)
+		}
+	}
+	for _, u := range pending {
+		balance.Unconfirmed = blockchain.CapAmounts(balance.Unconfirmed, u.Amount)
+	}
+	for _, u := range spending {
+		balance.Spending = blockchain.CapAmounts(balance.Spending, u.Amount)
+	}
+	return balance
+}
+
+// The payments to `addr` that are unspent on the chain and in the mempool
+// Sorted by height (the mempool last), then by tx and index
+func (l *Ledger) ListUnspent(addr utils.Address) []Unspent {
+	confirmed, pending, _ := l.unspent(addr)
+	return append(confirmed, pending...)
+}
+
+// The txs of `addr`, on the main chain and in the mempool, the latest first
+func (l *Ledger) History(addr utils.Address) []HistoryEntry {
+	var history []HistoryEntry
+	for _, tx := range l.pending_txs() {
+		if entry, ok := history_entry(tx, addr); ok {
+			entry.Height = -1
+			history = append(history, entry)
+		}
+	}
+	if l.BC.Tip() == nil {
+		return history
+	}
+	iter := blockchain.NewBlockChainIterator(l.BC)
+	tip := -1
+	for {
+		cur_block := iter.Next()
+		if tip < 0 {
+			tip = cur_block.Height
+		}
+		for i := len(cur_block.Txs) - 1; i >= 0; i-- {
+			if entry, ok := history_entry(cur_block.Txs[i], addr); ok {
+				entry.Height = cur_block.Height
+				entry.Confirmations = tip - cur_block.Height + 1
+				entry.Time = cur_block.Time
+				history = append(history, entry)
+			}
+		}
+		if cur_block.IsGenisis {
+			break
+		}
+	}
+	return history
+}
+
+func (l *Ledger) PrintBalance(addr utils.Address, min_conf int) string {
+	b := l.Balance(addr, min_conf)
+	return fmt.Sprintf("%s: confirmed %d, immature %d, unconfirmed %d, spending %d", addr, b.Confirmed, b.Immature, b.Unconfirmed, b.Spending)
+}
+
+// Split the payments to `addr` into:
+// - confirmed: unspent on the chain, and not spent by the mempool
+// - pending: paid by the mempool, and not spent by the mempool
+// - spending: unspent on the chain, but spent by the mempool
+func (l *Ledger) unspent(addr utils.Address) ([]Unspent, []Unspent, []Unspent) {
+	utxos, tip := blockchain.UTXOSet{BC: l.BC}.ListUnspent(addr.Bytes())
+	txs := l.pending_txs()
+	spent := make(map[string]bool)
+	for _, tx := range txs {
+		for _, in := range tx.Incomes {
+			spent[blockchain.Outpoint(in.HashTx, in.Idx)] = true
+		}
+	}
+	var confirmed, pending, spending []Unspent
+	for _, utxo := range utxos {
+		u := Unspent{
+			HashTx:        utxo.HashTx,
+			Idx:           utxo.Idx,
+			Amount:        utxo.Unspent.Out.Amount,
+			Height:        utxo.Unspent.Height,
+			Confirmations: tip - utxo.Unspent.Height + 1,
+			IsReward:      utxo.Unspent.IsReward,
+			Mature:        l.BC.Params.Mature(utxo.Unspent, tip+1),
+		}
+		if spent[blockchain.Outpoint(u.HashTx, u.Idx)] {
+			spending = append(spending, u)
+		} else {
+			confirmed = append(confirmed, u)
+		}
+	}
+	for _, tx := range txs {
+		for idx, out := range tx.Payments {
+			if bytes.Compare(out.Recipient, addr.Bytes()) != 0 || spent[blockchain.Outpoint(tx.Hash, idx)] {
+				continue
+			}
+			pending = append(pending, Unspent{
+				HashTx: tx.Hash,
+				Idx:    idx,
+				Amount: out.Amount,
+				Height: -1,
+				Mature: true,
+			})
+		}
+	}
+	sort_unspent(confirmed)
+	sort_unspent(pending)
+	sort_unspent(spending)
+	return confirmed, pending, spending
+}
+
+// The txs of the mempool, except rewards and the txs with an income that is gone (see blockchain.UTXOSet.LiveTxs)
+func (l *Ledger) pending_txs() []*blockchain.Transaction {
+	if l.Mempool == nil {
+		return nil
+	}
+	var pool []*blockchain.Transaction
+	for _, tx := range l.Mempool() {
+		if !tx.IsReward {
+			pool = append(pool, tx)
+		}
+	}
+	txs := blockchain.UTXOSet{BC: l.BC}.LiveTxs(pool)
+	sort.Slice(txs, func(i, j int) bool {
+		return bytes.Compare(txs[i].Hash, txs[j].Hash) < 0
+	})
+	return txs
+}
+
+// The entry of `tx` in the history of `addr`, if `tx` pays to or is initiated by `addr`
+func history_entry(tx *blockchain.Transaction, addr utils.Address) (HistoryEntry, bool) {
+	entry := HistoryEntry{
+		HashTx: tx.Hash,
+	}
+	involved := false
+	for _, out := range tx.Payments {
+		if bytes.Compare(out.Recipient, addr.Bytes()) == 0 {
+			entry.Received = blockchain.CapAmounts(entry.Received, out.Amount)
+			involved = true
+		}
+	}
+	if !tx.IsReward && string(utils.PKToAdress(tx.Initiator)) == addr.String() {
+		for _, in := range tx.Incomes {
+			entry.Sent = blockchain.CapAmounts(entry.Sent, in.Amount)
+		}
+		involved = true
+	}
+	entry.Net = int64(entry.Received) - int64(entry.Sent)
+	return entry, involved
+}
+
+func sort_unspent(unspent []Unspent) {
+	sort.Slice(unspent, func(i, j int) bool {
+		if unspent[i].Height != unspent[j].Height {
+			return unspent[i].Height < unspent[j].Height
+		}
+		if c := bytes.Compare(unspent[i].HashTx, unspent[j].HashTx); c != 0 {
+			return c < 0
+		}
+		return unspent[i].Idx < unspent[j].Idx
+	})
+}
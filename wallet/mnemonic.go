@@ -0,0 +1,78 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// A mnemonic is the seed of the HD wallets (see hd.go) written as words, to be backed up on paper.
+// The words encode the seed as in BIP39, with the English word list of BIP39 (english.txt, embedded in the binary):
+//		bits = seed | the first len(seed)/4 bits of SHA256(seed), cut into 11-bit indexes of words
+// A seed of 32 bytes gives 24 words. Unlike BIP39, the words are the seed itself (not stretched by PBKDF2),
+// so the seed restored from the words derives the same wallets.
+// A mnemonic whose checksum is wrong (e.g. a word mistyped or two words swapped) is refused.
+
+//go:embed english.txt
+var english string
+
+var word_list = strings.Fields(english)
+var word_index = make(map[string]int)
+
+var ErrBadChecksum = errors.New("wrong checksum of the mnemonic")
+
+func init() {
+	for i, word := range word_list {
+		word_index[word] = i
+	}
+}
+
+// Encode `seed` (16 to 32 bytes, a multiple of 4) as words
+func EncodeMnemonic(seed []byte) (string, error) {
+	if len(seed) < 16 || len(seed) > 32 || len(seed)%4 != 0 {
+		return "", fmt.Errorf("cannot encode a seed of %d bytes as words", len(seed))
+	}
+	checksum_bits := uint(len(seed) / 4)
+	hash := sha256.Sum256(seed)
+	bits := new(big.Int).SetBytes(seed)
+	bits.Lsh(bits, checksum_bits)
+	bits.Or(bits, big.NewInt(int64(hash[0]>>(8-checksum_bits))))
+	n := (len(seed)*8 + int(checksum_bits)) / 11
+	words := make([]string, n)
+	mask := big.NewInt(1<<11 - 1)
+	for i := n - 1; i >= 0; i-- {
+		words[i] = word_list[new(big.Int).And(bits, mask).Int64()]
+		bits.Rsh(bits, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Decode the words of `mnemonic` (separated by spaces) into the seed
+// Return an error if a word is not in the word list, the number of words is wrong, or the checksum is wrong
+func DecodeMnemonic(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("mnemonic of %d words, expect 12, 15, 18, 21 or 24", len(words))
+	}
+	bits := new(big.Int)
+	for i, word := range words {
+		index, ok := word_index[word]
+		if !ok {
+			return nil, fmt.Errorf("word %d %q is not in the word list", i+1, word)
+		}
+		bits.Lsh(bits, 11)
+		bits.Or(bits, big.NewInt(int64(index)))
+	}
+	checksum_bits := uint(len(words) / 3)
+	checksum := new(big.Int).And(bits, big.NewInt(int64(1)<<checksum_bits-1))
+	bits.Rsh(bits, checksum_bits)
+	seed := bits.FillBytes(make([]byte, len(words)*4/3))
+	hash := sha256.Sum256(seed)
+	if checksum.Int64() != int64(hash[0]>>(8-checksum_bits)) {
+		return nil, ErrBadChecksum
+	}
+	return seed, nil
+}
@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"Project2/blockchain"
+	"Project2/utils"
+)
+
+// A Spender makes the txs of wallets, and keeps track of the txs it has made that are not confirmed yet (pending):
+// - The payments spent by a pending tx are locked, so that the next tx never spends them again
+// - The change of a pending tx can be spent by the next tx of the wallet it is paid to at once, before the pending tx
+//   is confirmed (a block can include both, see blockchain.SelectTxs)
+// A pending tx is released, and the payments it spends unlocked, when:
+// - It is confirmed or dropped: one of its incomes is no longer unspent on the chain (or paid by a pending tx),
+//   since the tx or a tx conflicting with it is in a block. The txs spending its change are released with it.
+// - It expires: it is still pending after Expiry (never if 0)
+// - It is dropped by Drop: the miner drops a tx that no machine has received, and a tx it removes from its mempool
+
+type Spender struct {
+	BC      *blockchain.BlockChain
+	Expiry  time.Duration
+	lock    sync.Mutex
+	pending map[string]*pending_tx // map: hash of a tx -> pending tx
+}
+
+type pending_tx struct {
+	tx   *blockchain.Transaction
+	made time.Time
+}
+
+func NewSpender(bc *blockchain.BlockChain, expiry time.Duration) *Spender {
+	return &Spender{
+		BC:      bc,
+		Expiry:  expiry,
+		pending: make(map[string]*pending_tx),
+	}
+}
+
+// Make a tx of `w` that pays `amount` to `to` and `fee` to the miner, and the change to `change` (to `w` if empty),
+// and keep it pending
+// The incomes are the unlocked payments to `w`: mature payments on the chain first, then the change of pending txs
+// Return an error if `to` or `change` is not valid, the amounts are illegal, or `w` has not enough unlocked money
+func (s *Spender) Pay(w *Wallet, to utils.Address, amount blockchain.Amount, fee blockchain.Amount, change utils.Address) (*blockchain.Transaction, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release()
+	return s.pay(w, to, amount, fee, change)
+}
+
+// Make the tx of the first of `wallets` that has enough unlocked money, as Pay
+// Return the error of the last wallet if none has
+func (s *Spender) PayFrom(wallets []*Wallet, to utils.Address, amount blockchain.Amount, fee blockchain.Amount, change utils.Address) (*blockchain.Transaction, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release()
+	err := fmt.Errorf("no wallet to pay %d money to %s", amount, to)
+	for _, w := range wallets {
+		var tx *blockchain.Transaction
+		tx, err = s.pay(w, to, amount, fee, change)
+		if err == nil {
+			return tx, nil
+		}
+	}
+	return nil, err
+}
+
+// with `s.lock` held
+func (s *Spender) pay(w *Wallet, to utils.Address, amount blockchain.Amount, fee blockchain.Amount, change utils.Address) (*blockchain.Transaction, error) {
+	total, _ := blockchain.AddAmounts(amount, fee) // checked by NewPayment
+	tx, err := blockchain.NewPayment(w, s.select_incomes(w.Address, total), to, amount, fee, change)
+	if err != nil {
+		return nil, err
+	}
+	s.pending[hex.EncodeToString(tx.Hash)] = &pending_tx{
+		tx:   tx,
+		made: time.Now(),
+	}
+	return tx, nil
+}
+
+// Release the pending tx `hash`, and the pending txs spending its change
+func (s *Spender) Drop(hash []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pending, hex.EncodeToString(hash))
+	s.release()
+}
+
+// The pending txs, in the order they were made
+func (s *Spender) Pending() []*blockchain.Transaction {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release()
+	pending := s.sorted()
+	txs := make([]*blockchain.Transaction, len(pending))
+	for i, p := range pending {
+		txs[i] = p.tx
+	}
+	return txs
+}
+
+// The pending txs, the oldest first, with `s.lock` held
+func (s *Spender) sorted() []*pending_tx {
+	pending := make([]*pending_tx, 0, len(s.pending))
+	for _, p := range s.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].made.Before(pending[j].made)
+	})
+	return pending
+}
+
+// Release the expired pending txs, then the pending txs with an income that is gone (see blockchain.UTXOSet.LiveTxs)
+// with `s.lock` held
+func (s *Spender) release() {
+	now := time.Now()
+	var txs []*blockchain.Transaction
+	for key, p := range s.pending {
+		if s.Expiry > 0 && now.Sub(p.made) > s.Expiry {
+			delete(s.pending, key)
+		} else {
+			txs = append(txs, p.tx)
+		}
+	}
+	live := make(map[string]bool)
+	for _, tx := range (blockchain.UTXOSet{BC: s.BC}).LiveTxs(txs) {
+		live[hex.EncodeToString(tx.Hash)] = true
+	}
+	for key := range s.pending {
+		if !live[key] {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// Accumulate unlocked payments to `addr` until they reach `amount`, with `s.lock` held
+func (s *Spender) select_incomes(addr []byte, amount blockchain.Amount) []blockchain.In {
+	locked := make(map[string]bool)
+	for _, p := range s.pending {
+		for _, in := range p.tx.Incomes {
+			locked[blockchain.Outpoint(in.HashTx, in.Idx)] = true
+		}
+	}
+	var candidates []blockchain.In
+	utxos, tip := blockchain.UTXOSet{BC: s.BC}.ListUnspent(addr)
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Unspent.Height != utxos[j].Unspent.Height {
+			return utxos[i].Unspent.Height < utxos[j].Unspent.Height
+		}
+		return bytes.Compare(utxos[i].HashTx, utxos[j].HashTx) < 0
+	})
+	for _, utxo := range utxos {
+		if s.BC.Params.Mature(utxo.Unspent, tip+1) {
+			candidates = append(candidates, blockchain.In{
+				HashTx: utxo.HashTx,
+				Idx:    utxo.Idx,
+				Amount: utxo.Unspent.Out.Amount,
+			})
+		}
+	}
+	for _, p := range s.sorted() {
+		for idx, out := range p.tx.Payments {
+			if bytes.Compare(out.Recipient, addr) == 0 {
+				candidates = append(candidates, blockchain.In{
+					HashTx: p.tx.Hash,
+					Idx:    idx,
+					Amount: out.Amount,
+				})
+			}
+		}
+	}
+	acc := blockchain.Amount(0)
+	incomes := []blockchain.In{}
+	for _, in := range candidates {
+		if acc >= amount {
+			break
+		}
+		if locked[blockchain.Outpoint(in.HashTx, in.Idx)] {
+			continue
+		}
+		sum, ok := blockchain.AddAmounts(acc, in.Amount)
+		if !ok {
+			continue
+		}
+		acc = sum
+		incomes = append(incomes, in)
+	}
+	return incomes
+}
@@ -9,16 +9,20 @@ import (
 	"encoding/gob"
 	"bytes"
 	"io/ioutil"
+	"fmt"
+	"path/filepath"
 
 	"Project2/utils"
 )
 
 // A Wallet stores a pair of (sk, pk) and the address of the pk
+// The pk is in SEC1 (see utils/crypto.go)
 // A Wallet can:
-// - Generate a pair of (sk, pk) and store it to file
-// - Read a specific wallet from the file
+// - Generate a pair of (sk, pk) in memory (a Keystore stores it on disk encrypted, see keystore.go)
+// - Give its sk to sign txs
+// Wallets used to be stored unencrypted in LEGACY_DIR; Keystore.ImportLegacy moves them into a keystore.
 
-const DIR = "/osdata/osgroup10/wallet-"
+const LEGACY_DIR = "/osdata/osgroup10/wallet-" // legacy wallet files: LEGACY_DIR<mid>-<address>
 
 type Wallet struct {
 	SK []byte
@@ -26,50 +30,64 @@ type Wallet struct {
 	Address	[]byte
 }
 
-func NewWallet(machine_id string) []byte {
+func NewWallet() *Wallet {
 	// Generate key pair
 	curve := elliptic.P256()
 	sk, err := ecdsa.GenerateKey(curve, rand.Reader) // `sk` here is of type *ecdsa.PrivateKey
 	if err != nil {
 		log.Panic(err)
 	}
-	pk := append(sk.PublicKey.X.Bytes(), sk.PublicKey.Y.Bytes()...)
 	serialized_sk, err := x509.MarshalECPrivateKey(sk)
 	if err != nil {
 		log.Panic(err)
 	}
-	new_wallet := &Wallet{
+	return new_wallet(serialized_sk, &sk.PublicKey)
+}
+
+// The wallet of `serialized_sk`, whose pk is `pk`
+func new_wallet(serialized_sk []byte, pk *ecdsa.PublicKey) *Wallet {
+	encoded_pk := utils.EncodePublicKey(pk)
+	return &Wallet{
 		SK: serialized_sk,
-		PK: pk,
-		Address: utils.PKToAdress(pk),
-	}
-	// Save the wallet to disk
-	var data bytes.Buffer
-	encoder := gob.NewEncoder(&data)
-	err = encoder.Encode(*new_wallet)
-	if err != nil {
-		log.Panic(err)
-	}
-	filename := DIR + machine_id + "-" + string(new_wallet.Address)
-	err = ioutil.WriteFile(filename, data.Bytes(), 0600)
-	if err != nil {
-		log.Panic(err)
+		PK: encoded_pk,
+		Address: utils.PKToAdress(encoded_pk),
 	}
-	return new_wallet.Address
 }
 
-func ReadWallet(machine_id string, address string) *Wallet {
-	filename := DIR + machine_id + "-" + address
-	data, err := ioutil.ReadFile(filename)
+func (w *Wallet) PublicKey() []byte {
+	return w.PK
+}
+
+func (w *Wallet) PrivateKey() (*ecdsa.PrivateKey, error) {
+	return x509.ParseECPrivateKey(w.SK)
+}
+
+// Read the legacy wallet files of `machine_id`
+// The pk (and so the address) of a wallet is computed again from its sk, since a legacy pk may not be in SEC1
+// Return the wallets and their files
+func read_legacy_wallets(machine_id string) ([]*Wallet, []string, error) {
+	filenames, err := filepath.Glob(LEGACY_DIR + machine_id + "-*")
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, err
 	}
-	var wallet Wallet
-	gob.Register(elliptic.P256())
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err = decoder.Decode(&wallet)
-	if err != nil {
-		log.Panic(err)
+	var wallets []*Wallet
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		var legacy Wallet
+		gob.Register(elliptic.P256())
+		decoder := gob.NewDecoder(bytes.NewReader(data))
+		err = decoder.Decode(&legacy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to read wallet %s: %v", filename, err)
+		}
+		sk, err := legacy.PrivateKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to read wallet %s: %v", filename, err)
+		}
+		wallets = append(wallets, new_wallet(legacy.SK, &sk.PublicKey))
 	}
-	return &wallet
+	return wallets, filenames, nil
 }